@@ -0,0 +1,147 @@
+package ggen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ArgToken is a whitespace-separated token of a directive argument, with quotes and escapes removed. A token can be a
+// key=value or key:value pair, split at the first separator outside of quotes:
+//
+//	-name="Alice M"   Text: -name=Alice M   Key: -name   Value: Alice M
+//	"a b"             Text: a b
+//	path:'C:\dir'     Text: path:C:\dir     Key: path    Value: C:\dir
+type ArgToken struct {
+	Text  string
+	Key   string
+	Value string
+
+	// Sep is the separator between the key and the value ('=' or ':'), or 0 if the token is not a pair.
+	Sep byte
+
+	// Offset and ValueOffset are the byte offsets of the token and its value in the argument.
+	Offset      int
+	ValueOffset int
+}
+
+// ArgError is an error at a position in a directive argument.
+type ArgError struct {
+	Offset int // byte offset in the argument
+	Msg    string
+}
+
+func (e *ArgError) Error() string {
+	return fmt.Sprintf("offset %v: %v", e.Offset, e.Msg)
+}
+
+// TokenizeArgs splits a directive argument into tokens. Tokens are separated by spaces and tabs. Within a token:
+//
+//   - "double quotes" can contain spaces and backslash escapes: \" \\ \n \t
+//   - 'single quotes' are taken literally
+//   - outside of quotes, a backslash escapes the next character, for example a space or a separator
+func TokenizeArgs(arg string) ([]ArgToken, error) {
+	var tokens []ArgToken
+	i := 0
+	for {
+		for i < len(arg) && isArgSpace(arg[i]) {
+			i++
+		}
+		if i == len(arg) {
+			return tokens, nil
+		}
+		token := ArgToken{Offset: i}
+		var b strings.Builder
+		for ; i < len(arg) && !isArgSpace(arg[i]); i++ {
+			switch c := arg[i]; c {
+			case '"':
+				start := i
+				for i++; i < len(arg) && arg[i] != '"'; i++ {
+					if arg[i] != '\\' {
+						b.WriteByte(arg[i])
+						continue
+					}
+					if i++; i == len(arg) {
+						break
+					}
+					switch arg[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(arg[i])
+					}
+				}
+				if i >= len(arg) {
+					return nil, &ArgError{Offset: start, Msg: "unterminated quoted string"}
+				}
+			case '\'':
+				end := strings.IndexByte(arg[i+1:], '\'')
+				if end < 0 {
+					return nil, &ArgError{Offset: i, Msg: "unterminated quoted string"}
+				}
+				b.WriteString(arg[i+1 : i+1+end])
+				i += end + 1
+			case '\\':
+				if i+1 == len(arg) {
+					return nil, &ArgError{Offset: i, Msg: "trailing backslash"}
+				}
+				i++
+				b.WriteByte(arg[i])
+			case '=', ':':
+				if token.Sep == 0 {
+					token.Sep = c
+					token.Key = b.String()
+					token.ValueOffset = i + 1
+				}
+				b.WriteByte(c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		token.Text = b.String()
+		if token.Sep != 0 {
+			token.Value = token.Text[len(token.Key)+1:]
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+func isArgSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// KV is a key-value pair of a directive argument. A key without separator has HasValue false, like "required" in
+// "name=foo required".
+type KV struct {
+	Key      string
+	Value    string
+	HasValue bool
+
+	// Offset and ValueOffset are the byte offsets of the pair and its value in the argument.
+	Offset      int
+	ValueOffset int
+}
+
+// ParseKV parses the argument as a list of key=value or key:value pairs, in order. Keys may repeat. Errors are
+// *ArgError with the offset in the argument.
+//
+//	// +gen:sample name="Alice M" age:20 admin
+func (d Directive) ParseKV() ([]KV, error) {
+	tokens, err := TokenizeArgs(d.Arg)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]KV, 0, len(tokens))
+	for _, token := range tokens {
+		kv := KV{Key: token.Text, Offset: token.Offset}
+		if token.Sep != 0 {
+			kv = KV{Key: token.Key, Value: token.Value, HasValue: true, Offset: token.Offset, ValueOffset: token.ValueOffset}
+		}
+		if kv.Key == "" {
+			return nil, &ArgError{Offset: token.Offset, Msg: "missing key"}
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, nil
+}
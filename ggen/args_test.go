@@ -0,0 +1,49 @@
+package ggen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenizeArgs(t *testing.T) {
+	texts := func(arg string) []string {
+		args, err := Directive{Arg: arg}.GetArgs()
+		require.NoError(t, err)
+		return args
+	}
+	require.Nil(t, texts(""))
+	require.Equal(t, []string{"a", "b"}, texts(" a \tb "))
+	require.Equal(t, []string{"-name=Alice M", "DoSomething"}, texts(`-name="Alice M" DoSomething`))
+	require.Equal(t, []string{`say "hi"`, "a\nb"}, texts(`"say \"hi\"" "a\nb"`))
+	require.Equal(t, []string{`C:\dir`, "a b"}, texts(`'C:\dir' a\ b`))
+
+	tokens, err := TokenizeArgs(`name="Alice M" path:'a:b' x\=y`)
+	require.NoError(t, err)
+	require.Equal(t, []ArgToken{
+		{Text: "name=Alice M", Key: "name", Value: "Alice M", Sep: '=', Offset: 0, ValueOffset: 5},
+		{Text: "path:a:b", Key: "path", Value: "a:b", Sep: ':', Offset: 15, ValueOffset: 20},
+		{Text: "x=y", Offset: 26},
+	}, tokens)
+
+	for arg, offset := range map[string]int{`a "b`: 2, `a 'b`: 2, `a\`: 1} {
+		_, err = TokenizeArgs(arg)
+		var argErr *ArgError
+		require.ErrorAs(t, err, &argErr, arg)
+		require.Equal(t, offset, argErr.Offset, arg)
+	}
+}
+
+func TestParseKV(t *testing.T) {
+	kvs, err := Directive{Arg: `name="Alice M" age:20 admin name=Bob`}.ParseKV()
+	require.NoError(t, err)
+	require.Equal(t, []KV{
+		{Key: "name", Value: "Alice M", HasValue: true, Offset: 0, ValueOffset: 5},
+		{Key: "age", Value: "20", HasValue: true, Offset: 15, ValueOffset: 19},
+		{Key: "admin", Offset: 22},
+		{Key: "name", Value: "Bob", HasValue: true, Offset: 28, ValueOffset: 33},
+	}, kvs)
+
+	_, err = Directive{Arg: `a=1 =2`}.ParseKV()
+	require.EqualError(t, err, "offset 4: missing key")
+}
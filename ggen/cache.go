@@ -0,0 +1,388 @@
+package ggen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// cacheFormat is bumped whenever the way input hashes are computed changes, to invalidate old caches.
+const cacheFormat = 1
+
+type cacheKey struct {
+	Plugin  string
+	PkgPath string
+}
+
+type cacheEntry struct {
+	Plugin    string `json:"plugin"`
+	PkgPath   string `json:"pkg"`
+	InputHash string `json:"input"`
+
+	// Outputs maps generated files to the hash of their content.
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+type cacheData struct {
+	Format  int           `json:"format"`
+	Entries []*cacheEntry `json:"entries"`
+}
+
+// cache keeps track of the inputs and outputs of each (plugin, package) pair, so packages whose inputs have not changed
+// since the last run can be skipped. Only plugins implementing Versioner are cached. Without a cache file, the entries
+// are read from the manifest.
+type cache struct {
+	path string
+
+	prev    map[cacheKey]*cacheEntry
+	fresh   map[cacheKey]*cacheEntry
+	next    map[cacheKey]*cacheEntry
+	outputs map[cacheKey][]string
+
+	// freshFiles are the outputs of fresh entries, which must not be cleaned.
+	freshFiles map[string]bool
+
+	skipped    int
+	skippedPls map[string]int
+}
+
+// inputHasher computes the input hashes of packages from the first load.
+type inputHasher struct {
+	pkgs      map[string]*packages.Package
+	pkgHashes map[string]string
+}
+
+func newInputHasher(pkgs []*packages.Package) *inputHasher {
+	h := &inputHasher{
+		pkgs:      make(map[string]*packages.Package),
+		pkgHashes: make(map[string]string),
+	}
+	packages.Visit(pkgs, func(pkg *packages.Package) bool {
+		h.pkgs[pkg.PkgPath] = pkg
+		return true
+	}, nil)
+	return h
+}
+
+// loadCache reads the cache file and determines which (plugin, package) pairs are fresh: their inputs are unchanged
+// and their outputs are still on disk.
+func (ng *engine) loadCache() error {
+	if ng.xcfg.CacheFile == "" && ng.manifest == nil || ng.xcfg.DryRun || ng.xcfg.Output != nil {
+		return nil
+	}
+	c := &cache{
+		path:       ng.xcfg.CacheFile,
+		prev:       make(map[cacheKey]*cacheEntry),
+		fresh:      make(map[cacheKey]*cacheEntry),
+		next:       make(map[cacheKey]*cacheEntry),
+		outputs:    make(map[cacheKey][]string),
+		freshFiles: make(map[string]bool),
+		skippedPls: make(map[string]int),
+	}
+	ng.cache = c
+
+	entries, err := ng.readCacheEntries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key := cacheKey{Plugin: entry.Plugin, PkgPath: entry.PkgPath}
+		c.prev[key] = entry
+	}
+	for key, entry := range c.prev {
+		pl := ng.pluginsMap[key.Plugin]
+		if pl == nil || !pl.enabled || pl.version == "" {
+			continue
+		}
+		inputHash, ok := ng.inputHash(pl, key.PkgPath)
+		if !ok || inputHash != entry.InputHash || !outputsExist(entry.Outputs) {
+			continue
+		}
+		c.fresh[key] = entry
+		for filePath := range entry.Outputs {
+			c.freshFiles[filePath] = true
+		}
+	}
+	return nil
+}
+
+// readCacheEntries reads the entries from the cache file, or from the manifest if there is no cache file.
+func (ng *engine) readCacheEntries() ([]*cacheEntry, error) {
+	path := ng.xcfg.CacheFile
+	if path == "" {
+		return ng.manifestCacheEntries(), nil
+	}
+	body, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, Errorf(err, "can not read cache file %v: %v", path, err)
+	}
+	var data cacheData
+	if err = json.Unmarshal(body, &data); err != nil {
+		ng.warn("ignore invalid cache file", "file", path, "err", err)
+		return nil, nil
+	}
+	if data.Format != cacheFormat {
+		return nil, nil
+	}
+	return data.Entries, nil
+}
+
+// skipFreshPackages excludes fresh packages from generating. Fresh outputs of packages that are no longer included are
+// marked for deletion.
+func (ng *engine) skipFreshPackages() error {
+	c := ng.cache
+	if c == nil {
+		return nil
+	}
+	for key, entry := range c.fresh {
+		pl := ng.pluginsMap[key.Plugin]
+		flags := ng.includedPackages[key.PkgPath]
+		if flags != nil && flags[pl.index] {
+			ng.logger.Debug("skip unchanged package", "plugin", pl.name, "pkg", key.PkgPath)
+			flags[pl.index] = false
+			c.next[key] = entry
+			c.skipped++
+			c.skippedPls[pl.name]++
+			continue
+		}
+		for filePath := range entry.Outputs {
+			if err := ng.rememberPreviousFile(filePath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allSkipped reports whether all included packages are skipped because they are fresh.
+func (c *cache) allSkipped(includedPackages []includedPackage) bool {
+	return c != nil && c.skipped > 0 && len(includedPackages) == 0
+}
+
+func (c *cache) isPluginSkipped(pl *pluginStruct) bool {
+	return c.skippedCount(pl) > 0
+}
+
+func (c *cache) skippedCount(pl *pluginStruct) int {
+	if c == nil {
+		return 0
+	}
+	return c.skippedPls[pl.name]
+}
+
+func (c *cache) isFreshFile(filePath string) bool {
+	return c != nil && c.freshFiles[filePath]
+}
+
+func (c *cache) recordOutput(pl *pluginStruct, pkgPath, filePath string) {
+	if c == nil || pl.version == "" || pkgPath == "" {
+		return
+	}
+	key := cacheKey{Plugin: pl.name, PkgPath: pkgPath}
+	c.outputs[key] = append(c.outputs[key], filePath)
+}
+
+// saveCache records the generated (plugin, package) pairs and writes the cache file.
+func (ng *engine) saveCache() error {
+	c := ng.cache
+	if c == nil {
+		return nil
+	}
+	for _, pl := range ng.enabledPlugins {
+		if pl.version == "" {
+			continue
+		}
+		for _, p := range ng.sortedIncludedPackages {
+			if !p.Included[pl.index] {
+				continue
+			}
+			inputHash, ok := ng.inputHash(pl, p.PkgPath)
+			if !ok {
+				continue
+			}
+			key := cacheKey{Plugin: pl.name, PkgPath: p.PkgPath}
+			entry := &cacheEntry{Plugin: pl.name, PkgPath: p.PkgPath, InputHash: inputHash}
+			for _, filePath := range c.outputs[key] {
+				if entry.Outputs == nil {
+					entry.Outputs = make(map[string]string)
+				}
+				entry.Outputs[filePath] = hashBytes(ng.stagedFiles[filePath])
+			}
+			c.next[key] = entry
+		}
+	}
+
+	if c.path == "" {
+		return nil // the manifest is used as the cache
+	}
+	data := cacheData{Format: cacheFormat}
+	for _, entry := range c.next {
+		data.Entries = append(data.Entries, entry)
+	}
+	sort.Slice(data.Entries, func(i, j int) bool {
+		a, b := data.Entries[i], data.Entries[j]
+		if a.PkgPath != b.PkgPath {
+			return a.PkgPath < b.PkgPath
+		}
+		return a.Plugin < b.Plugin
+	})
+	body, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return Errorf(err, "can not encode cache: %v", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return Errorf(err, "create directory %q: %v", filepath.Dir(c.path), err)
+	}
+	if err = os.WriteFile(c.path, body, 0644); err != nil {
+		return Errorf(err, "can not write cache file %v: %v", c.path, err)
+	}
+	return nil
+}
+
+// inputHash returns the hash of everything that affects the output of a plugin for a package: the plugin name, version
+// and options, the generated file name, the build tags, the goimports options, the enabled post-processors, and the
+// sources of the package and its dependencies. In multi-pass mode, it also covers the plugins that the plugin depends
+// on, because it reads their generated files. It returns false if the package was not loaded.
+func (ng *engine) inputHash(pl *pluginStruct, pkgPath string) (string, bool) {
+	pkg := ng.hasher.pkgs[pkgPath]
+	if pkg == nil {
+		return "", false
+	}
+	h := sha256.New()
+	fileName := ng.genFilename(GenerateFileNameInput{PluginName: pl.name})
+	writeHashStrings(h, "ggen", pl.name, pl.version, fileName, strings.Join(ng.xcfg.BuildTags, ","))
+	writeHashStrings(h, pl.options.hashStrings()...)
+	writeHashStrings(h, ng.goimports.hashStrings()...)
+	for _, pp := range ng.enabledPlugins {
+		// post-processors only run on generated files, so their outputs depend on them
+		if _, ok := pp.plugin.(PostProcessor); ok {
+			writeHashStrings(h, "post-process", pp.name, pp.version)
+		}
+	}
+	if ng.xcfg.MultiPass {
+		for _, dep := range ng.dependencyPlugins(pl) {
+			writeHashStrings(h, "depends-on", dep.name, dep.version)
+			writeHashStrings(h, dep.options.hashStrings()...)
+		}
+	}
+	writeHashStrings(h, ng.packageHash(pkg))
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// dependencyPlugins returns the plugins that the plugin depends on, directly or transitively, sorted by name.
+func (ng *engine) dependencyPlugins(pl *pluginStruct) []*pluginStruct {
+	seen := make(map[string]bool)
+	var deps []*pluginStruct
+	var visit func(pl *pluginStruct)
+	visit = func(pl *pluginStruct) {
+		for _, name := range pl.dependsOn {
+			dep := ng.pluginsMap[name]
+			if dep == nil || seen[name] {
+				continue
+			}
+			seen[name] = true
+			deps = append(deps, dep)
+			visit(dep)
+		}
+	}
+	visit(pl)
+	sort.Slice(deps, func(i, j int) bool { return deps[i].name < deps[j].name })
+	return deps
+}
+
+// packageHash hashes the sources of a package and, recursively, the hashes of its imports. Generated files are
+// excluded. Packages from GOROOT and the module cache are immutable, so only their paths are hashed.
+func (ng *engine) packageHash(pkg *packages.Package) string {
+	h0 := ng.hasher
+	if hash, ok := h0.pkgHashes[pkg.PkgPath]; ok {
+		return hash
+	}
+	h0.pkgHashes[pkg.PkgPath] = "" // break import cycles
+
+	h := sha256.New()
+	writeHashStrings(h, pkg.PkgPath)
+	for _, file := range pkg.CompiledGoFiles {
+		if ng.cleanedFileNames[filepath.Base(file)] {
+			continue
+		}
+		if isImmutableFile(file) {
+			writeHashStrings(h, file, runtime.Version())
+			continue
+		}
+		body, err := os.ReadFile(file)
+		if err != nil {
+			// the hash will never match, so the package is always regenerated
+			writeHashStrings(h, file, err.Error())
+			continue
+		}
+		writeHashStrings(h, filepath.Base(file), hashBytes(body))
+	}
+	importPaths := make([]string, 0, len(pkg.Imports))
+	for path := range pkg.Imports {
+		importPaths = append(importPaths, path)
+	}
+	sort.Strings(importPaths)
+	for _, path := range importPaths {
+		writeHashStrings(h, path, ng.packageHash(pkg.Imports[path]))
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	h0.pkgHashes[pkg.PkgPath] = hash
+	return hash
+}
+
+func outputsExist(outputs map[string]string) bool {
+	for filePath, hash := range outputs {
+		body, err := os.ReadFile(filePath)
+		if err != nil || hashBytes(body) != hash {
+			return false
+		}
+	}
+	return true
+}
+
+var immutableDirs = func() []string {
+	dirs := []string{filepath.Join(build.Default.GOROOT, "src") + string(filepath.Separator)}
+	modCache := os.Getenv("GOMODCACHE")
+	if modCache == "" {
+		if gopaths := filepath.SplitList(build.Default.GOPATH); len(gopaths) > 0 {
+			modCache = filepath.Join(gopaths[0], "pkg", "mod")
+		}
+	}
+	if modCache != "" {
+		dirs = append(dirs, modCache+string(filepath.Separator))
+	}
+	return dirs
+}()
+
+func isImmutableFile(file string) bool {
+	for _, dir := range immutableDirs {
+		if strings.HasPrefix(file, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashBytes(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeHashStrings(h io.Writer, ss ...string) {
+	for _, s := range ss {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+}
@@ -1,7 +1,9 @@
 package ggen
 
 import (
+	"context"
 	"os"
+	"time"
 
 	"github.com/iolivernguyen/ggen/ggen/logging"
 )
@@ -13,22 +15,89 @@ type GenerateFileNameInput struct {
 type Config struct {
 	Plugins []Plugin
 
-	// Map of enabled plugins. Leave this nil to enable all plugins.
+	// Map of enabled plugins. Leave this nil to enable all plugins. Plugins enabled with EnablePlugin run in the order
+	// of the calls, the others run in the order of their names.
 	EnabledPlugins map[string]bool
 
+	// PluginOptions are the options of each plugin, keyed by plugin name then by option key. The values are parsed and
+	// validated against the options declared by the plugin, see Configurable.
+	PluginOptions map[string]map[string]string
+
+	// Overrides change the enabled plugins for the packages in some directories. See DirOverride.
+	Overrides []DirOverride
+
 	// default to "zz_generated.{{.Name}}.go"
 	GenerateFileName func(GenerateFileNameInput) string
 
 	CleanOnly bool
 
+	// RemoveOrphans deletes generated files that are no longer produced: their plugin is not registered anymore, or
+	// their plugin is enabled but did not generate them in this run. When false, orphans are only reported. Without
+	// ManifestFile, only the package directories and the directories written in this run are checked for orphans.
+	RemoveOrphans bool
+
+	// DryRun reports the files that would be created, updated or deleted without touching the disk. The changes are
+	// returned in Result.Files, together with their would-be content.
+	DryRun bool
+
+	// Check renders all files in memory like DryRun and compares them with the files on disk. Start returns a
+	// *StaleError if any generated file is out of date, missing or orphaned. Each FileChange carries a unified diff.
+	Check bool
+
 	Namespace string
 
+	// CacheFile enables incremental generation. It records the source hashes of each generated package and its
+	// dependencies, so packages whose inputs have not changed since the last run are skipped and their generated
+	// files are kept. Only plugins implementing Versioner are cached. The cache is not used in dry-run mode.
+	CacheFile string
+
+	// MultiPass runs the plugins in stages, so plugins can type-check against the code generated by their dependencies
+	// (see Dependent). A plugin runs in the stage after all of its dependencies. After each stage, the generated Go
+	// files are added to the overlay and the packages are loaded again. All plugins still filter packages before the
+	// first stage.
+	MultiPass bool
+
+	// Dir is the directory in which the patterns are resolved and the packages are loaded. It must be inside a module.
+	// If empty, the current directory is used. Other paths in Config are still relative to the current directory.
+	Dir string
+
+	// ManifestFile is the path of an optional manifest, for example "ggen.manifest.json" at the module root. It lists
+	// every generated file with its plugin, source package, input hash and output hash. When it exists, files listed in
+	// the manifest are cleaned and checked for orphans instead of scanning directories, and it is used as the cache if
+	// CacheFile is empty. See Manifest.
+	ManifestFile string
+
+	// Output receives the generated files instead of the source tree, for example NewMemFS, NewDirFS, NewZipFS or
+	// NewTarFS. All generated files are written to it, including the ones with unchanged content, and the deleted files
+	// are removed from it. The existing files are still read from the source tree for cleaning and reporting changes.
+	// The cache is disabled, because it relies on the outputs in the source tree.
+	Output OutputFS
+
+	// WatchInterval is the polling interval of Watch. Default to 1 second.
+	WatchInterval time.Duration
+
+	// GoimportsArgs are goimports flags, mapped to the options of the in-process goimports: -local, -format-only and
+	// -e are supported.
 	GoimportsArgs []string
 
 	BuildTags []string
 
 	LogLevel   LogLevel
 	LogHandler LogHandler
+
+	// pluginOrder records the order of EnablePlugin calls.
+	pluginOrder []string
+}
+
+// DirOverride changes the enabled plugins for the packages in a directory and its subdirectories. When directories are
+// nested, the innermost override applies.
+type DirOverride struct {
+	// Dir is an absolute path, or relative to the current directory.
+	Dir string
+
+	// Plugins are the plugins generating the packages in Dir. They must also be enabled globally. An empty list
+	// disables all plugins in Dir.
+	Plugins []string
 }
 
 func (c *Config) RegisterPlugin(plugins ...Plugin) {
@@ -38,12 +107,26 @@ func (c *Config) RegisterPlugin(plugins ...Plugin) {
 func (c *Config) EnablePlugin(names ...string) {
 	if c.EnabledPlugins == nil {
 		c.EnabledPlugins = map[string]bool{}
+		c.pluginOrder = nil
 	}
 	for _, name := range names {
+		if !c.EnabledPlugins[name] {
+			c.pluginOrder = append(c.pluginOrder, name)
+		}
 		c.EnabledPlugins[name] = true
 	}
 }
 
+func (c *Config) SetPluginOption(plugin, key, value string) {
+	if c.PluginOptions == nil {
+		c.PluginOptions = map[string]map[string]string{}
+	}
+	if c.PluginOptions[plugin] == nil {
+		c.PluginOptions[plugin] = map[string]string{}
+	}
+	c.PluginOptions[plugin][key] = value
+}
+
 func (c *Config) defaultLogHandler() LogHandler {
 	handler := defaultLogHandler{
 		w:     os.Stderr,
@@ -52,12 +135,22 @@ func (c *Config) defaultLogHandler() LogHandler {
 	return handler
 }
 
-func Start(cfg Config, patterns ...string) error {
+func Start(cfg Config, patterns ...string) (*Result, error) {
+	return StartContext(context.Background(), cfg, patterns...)
+}
+
+// StartContext is like Start, but stops when the context is done. The context is used for loading packages and is
+// available to plugins through Engine.Context and FilterEngine.Context. It is checked between plugins and packages.
+// When it is done, nothing is written and the error wraps the context error.
+func StartContext(ctx context.Context, cfg Config, patterns ...string) (*Result, error) {
+	ng := newEngineFromConfig(&cfg)
+	return ng.start(ctx, cfg, patterns...)
+}
+
+func newEngineFromConfig(cfg *Config) *engine {
 	if cfg.LogHandler == nil {
 		cfg.LogHandler = cfg.defaultLogHandler()
 	}
 	logger = logging.NewLogger(cfg.LogHandler)
-
-	ng := newEngine(logger)
-	return ng.start(cfg, patterns...)
+	return newEngine(logger)
 }
@@ -0,0 +1,212 @@
+package ggen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileNames are the names of the project config file, in the order of lookup.
+var ConfigFileNames = []string{"ggen.yaml", "ggen.yml", "ggen.json"}
+
+// ConfigFile is the declarative project config, usually ggen.yaml at the module root:
+//
+//	patterns: [./...]
+//	plugins: [sample, other]        # enabled plugins, in running order (default to all)
+//	build_tags: [integration]
+//	goimports_local: github.com/myproject
+//	file_name: zz_generated.%v.go   # %v is replaced by the plugin name
+//	namespace: github.com/myproject
+//	options:
+//	  sample:
+//	    key: value
+//	overrides:
+//	  - dir: internal/legacy        # relative to the config file
+//	    plugins: [sample]           # enabled plugins for packages in the directory
+//	templates:
+//	  - file: tools/*.ggen.tmpl     # template plugins, see TemplatePlugin
+//	  - name: stringer              # inline template, the command defaults to gen:<name>
+//	    command: gen:stringer
+//	    template: |
+//	      {{range .Objects}}...{{end}}
+type ConfigFile struct {
+	// Path is the path of the config file. Relative paths in the file are relative to its directory.
+	Path string `json:"-" yaml:"-"`
+
+	Patterns       []string                  `json:"patterns" yaml:"patterns"`
+	Plugins        []string                  `json:"plugins" yaml:"plugins"`
+	BuildTags      []string                  `json:"build_tags" yaml:"build_tags"`
+	GoimportsLocal string                    `json:"goimports_local" yaml:"goimports_local"`
+	FileName       string                    `json:"file_name" yaml:"file_name"`
+	Namespace      string                    `json:"namespace" yaml:"namespace"`
+	Options        map[string]map[string]any `json:"options" yaml:"options"`
+	Overrides      []ConfigFileOverride      `json:"overrides" yaml:"overrides"`
+	Templates      []ConfigFileTemplate      `json:"templates" yaml:"templates"`
+}
+
+type ConfigFileOverride struct {
+	Dir     string   `json:"dir" yaml:"dir"`
+	Plugins []string `json:"plugins" yaml:"plugins"`
+}
+
+// ConfigFileTemplate declares template plugins, either from files (a path, a glob pattern or a directory) or inline.
+type ConfigFileTemplate struct {
+	File     string `json:"file" yaml:"file"`
+	Name     string `json:"name" yaml:"name"`
+	Command  string `json:"command" yaml:"command"`
+	Template string `json:"template" yaml:"template"`
+}
+
+// FindConfigFile looks for a config file in dir and its parents, up to the module root (the directory containing
+// go.mod). It returns an empty path if there is no config file.
+func FindConfigFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		for _, name := range ConfigFileNames {
+			filePath := filepath.Join(dir, name)
+			if _, err = os.Stat(filePath); err == nil {
+				return filePath, nil
+			}
+		}
+		if _, err = os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return "", nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// LoadConfigFile reads a config file in YAML or JSON, depending on its extension. Unknown fields are rejected.
+func LoadConfigFile(filePath string) (*ConfigFile, error) {
+	body, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, Errorf(err, "can not read config file %v: %v", filePath, err)
+	}
+	var cf ConfigFile
+	if filepath.Ext(filePath) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cf)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(body))
+		dec.KnownFields(true)
+		if err = dec.Decode(&cf); err != nil && len(bytes.TrimSpace(body)) == 0 {
+			err = nil // empty file
+		}
+	}
+	if err != nil {
+		return nil, Errorf(err, "invalid config file %v: %v", filePath, err)
+	}
+	cf.Path, err = filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &cf, nil
+}
+
+// Dir returns the directory of the config file, in which the patterns are resolved.
+func (cf *ConfigFile) Dir() string {
+	return filepath.Dir(cf.Path)
+}
+
+// Apply sets the fields of cfg from the config file. Fields which are not in the file are kept. Patterns are not part
+// of Config, they are passed to Start together with Dir.
+func (cf *ConfigFile) Apply(cfg *Config) error {
+	if len(cf.Plugins) != 0 {
+		cfg.EnabledPlugins = nil
+		cfg.EnablePlugin(cf.Plugins...)
+	}
+	if len(cf.BuildTags) != 0 {
+		cfg.BuildTags = cf.BuildTags
+	}
+	if cf.GoimportsLocal != "" {
+		cfg.GoimportsArgs = append(cfg.GoimportsArgs, "-local", cf.GoimportsLocal)
+	}
+	if cf.FileName != "" {
+		if strings.Count(cf.FileName, "%v") != 1 || strings.Contains(cf.FileName, "/") {
+			return Errorf(nil, "%v: file_name must be a file name containing %%v once (got %q)", cf.Path, cf.FileName)
+		}
+		cfg.GenerateFileName = defaultFileNameGenerator(cf.FileName)
+	}
+	if cf.Namespace != "" {
+		cfg.Namespace = cf.Namespace
+	}
+
+	// sort for deterministic errors
+	plNames := make([]string, 0, len(cf.Options))
+	for plName := range cf.Options {
+		plNames = append(plNames, plName)
+	}
+	sort.Strings(plNames)
+	for _, plName := range plNames {
+		for key, value := range cf.Options[plName] {
+			switch value.(type) {
+			case map[string]any, []any:
+				return Errorf(nil, "%v: option %v.%v must be a scalar value", cf.Path, plName, key)
+			}
+			cfg.SetPluginOption(plName, key, fmt.Sprint(value))
+		}
+	}
+
+	for _, o := range cf.Overrides {
+		if o.Dir == "" {
+			return Errorf(nil, "%v: override without dir", cf.Path)
+		}
+		dir := o.Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(cf.Dir(), filepath.FromSlash(dir))
+		}
+		cfg.Overrides = append(cfg.Overrides, DirOverride{Dir: dir, Plugins: o.Plugins})
+	}
+
+	for _, t := range cf.Templates {
+		if err := cf.registerTemplates(cfg, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cf *ConfigFile) registerTemplates(cfg *Config, t ConfigFileTemplate) error {
+	switch {
+	case t.File != "" && (t.Name != "" || t.Command != "" || t.Template != ""):
+		return Errorf(nil, "%v: template file %v can not have name, command or template", cf.Path, t.File)
+	case t.File != "":
+		pattern := t.File
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(cf.Dir(), filepath.FromSlash(pattern))
+		}
+		plugins, err := LoadTemplatePlugins(pattern)
+		if err != nil {
+			return err
+		}
+		if len(plugins) == 0 {
+			return Errorf(nil, "%v: no template matches %v", cf.Path, t.File)
+		}
+		for _, pl := range plugins {
+			cfg.RegisterPlugin(pl)
+		}
+		return nil
+	case t.Name == "" || t.Template == "":
+		return Errorf(nil, "%v: template must have either file, or name and template", cf.Path)
+	default:
+		pl, err := NewTemplatePlugin(t.Name, t.Command, t.Template)
+		if err != nil {
+			return Errorf(err, "%v: %v", cf.Path, err)
+		}
+		cfg.RegisterPlugin(pl)
+		return nil
+	}
+}
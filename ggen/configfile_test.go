@@ -0,0 +1,100 @@
+package ggen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, body string) string {
+		filePath := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(body), 0644))
+		return filePath
+	}
+	writeFile("go.mod", "module example.com/sample\n")
+
+	t.Run("find", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+		configPath, err := FindConfigFile(filepath.Join(dir, "a", "b"))
+		require.NoError(t, err)
+		require.Empty(t, configPath, "stop at the module root")
+
+		expected := writeFile("ggen.yaml", "")
+		configPath, err = FindConfigFile(filepath.Join(dir, "a", "b"))
+		require.NoError(t, err)
+		require.Equal(t, expected, configPath)
+	})
+	t.Run("yaml", func(t *testing.T) {
+		configPath := writeFile("ggen.yaml", `
+patterns: [./...]
+plugins: [b, a]
+build_tags: [integration]
+goimports_local: example.com/sample
+file_name: gen.%v.go
+options:
+  a:
+    count: 10
+    name: foo
+overrides:
+  - dir: legacy
+    plugins: []
+`)
+		cf, err := LoadConfigFile(configPath)
+		require.NoError(t, err)
+		require.Equal(t, []string{"./..."}, cf.Patterns)
+		require.Equal(t, dir, cf.Dir())
+
+		var cfg Config
+		require.NoError(t, cf.Apply(&cfg))
+		require.Equal(t, []string{"b", "a"}, enabledPluginNames(&cfg))
+		require.Equal(t, []string{"integration"}, cfg.BuildTags)
+		require.Equal(t, []string{"-local", "example.com/sample"}, cfg.GoimportsArgs)
+		require.Equal(t, "gen.a.go", cfg.GenerateFileName(GenerateFileNameInput{PluginName: "a"}))
+		require.Equal(t, map[string]map[string]string{"a": {"count": "10", "name": "foo"}}, cfg.PluginOptions)
+		require.Equal(t, []DirOverride{{Dir: filepath.Join(dir, "legacy"), Plugins: []string{}}}, cfg.Overrides)
+	})
+	t.Run("json", func(t *testing.T) {
+		configPath := writeFile("ggen.json", `{"plugins": ["a"], "namespace": "example.com"}`)
+		cf, err := LoadConfigFile(configPath)
+		require.NoError(t, err)
+
+		var cfg Config
+		require.NoError(t, cf.Apply(&cfg))
+		require.Equal(t, map[string]bool{"a": true}, cfg.EnabledPlugins)
+		require.Equal(t, "example.com", cfg.Namespace)
+	})
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := LoadConfigFile(writeFile("unknown.yaml", "plugin: [a]\n"))
+		require.ErrorContains(t, err, "field plugin not found")
+	})
+	t.Run("invalid file name", func(t *testing.T) {
+		cf, err := LoadConfigFile(writeFile("invalid.yaml", "file_name: gen.go\n"))
+		require.NoError(t, err)
+		require.ErrorContains(t, cf.Apply(&Config{}), "file_name must be a file name")
+	})
+	t.Run("templates", func(t *testing.T) {
+		writeFile(filepath.Join("tools", "enum.ggen.tmpl"), "{{/* command: gen:enum */}}{{.Package.Name}}")
+		cf, err := LoadConfigFile(writeFile("templates.yaml", `
+templates:
+  - file: tools
+  - name: inline
+    template: "{{.Package.Name}}"
+`))
+		require.NoError(t, err)
+
+		var cfg Config
+		require.NoError(t, cf.Apply(&cfg))
+		require.Len(t, cfg.Plugins, 2)
+		require.Equal(t, "gen:enum", cfg.Plugins[0].(*TemplatePlugin).Command())
+		require.Equal(t, "gen:inline", cfg.Plugins[1].(*TemplatePlugin).Command())
+
+		cf, err = LoadConfigFile(writeFile("templates.yaml", "templates: [{name: invalid}]\n"))
+		require.NoError(t, err)
+		require.ErrorContains(t, cf.Apply(&Config{}), "template must have either file, or name and template")
+	})
+}
@@ -0,0 +1,254 @@
+package ggen
+
+import (
+	"encoding"
+	"errors"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Decode fills the struct pointed to by v from the key-value pairs of the directive argument (see ParseKV). Fields are
+// matched by their ggen tag, or by their lower-cased name:
+//
+//	type SampleArgs struct {
+//		Name  string        `ggen:"name,required"`
+//		Count int           `ggen:"count,default=10"`
+//		Mode  string        `ggen:"mode,enum=fast|safe"`
+//		Tags  []string      `ggen:"tags"`           // tags=a,b or repeated tags=a tags=b
+//		Wait  time.Duration `ggen:"wait,default=1s"`
+//		Debug bool          `ggen:"debug"`          // a key without value is true
+//		Skip  string        `ggen:"-"`
+//	}
+//
+//	// +gen:sample name="Alice M" mode=fast tags=a,b debug
+//
+// Supported types are string, bool, integers, floats, time.Duration, slices of these, and encoding.TextUnmarshaler.
+// The default value can not contain a comma. Unknown keys are rejected. Errors start with the position of the invalid
+// argument when the position of the directive is known.
+func (d Directive) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return Errorf(nil, "directive %v: decode: expected a pointer to struct, got %T", d.Raw, v)
+	}
+	if err := d.decode(rv.Elem()); err != nil {
+		if !d.Position.IsValid() {
+			return Errorf(err, "directive %v: %v", d.Raw, err)
+		}
+		pos, msg := d.Position, err.Error()
+		var argErr *ArgError
+		if errors.As(err, &argErr) {
+			pos, msg = d.argPosition(argErr.Offset), argErr.Msg
+		}
+		return Errorf(err, "%v: directive %v: %v", pos, d.Raw, msg)
+	}
+	return nil
+}
+
+// DecodeAll decodes every directive with the given command into a new element of the slice pointed to by v. The
+// elements can be structs or pointers to structs.
+func (ds Directives) DecodeAll(cmd string, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return Errorf(nil, "decode %v: expected a pointer to slice, got %T", cmd, v)
+	}
+	slice := rv.Elem()
+	elemType := slice.Type().Elem()
+	structType := elemType
+	if elemType.Kind() == reflect.Pointer {
+		structType = elemType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return Errorf(nil, "decode %v: expected a slice of structs, got %T", cmd, v)
+	}
+
+	var errs []error
+	for _, d := range ds {
+		if d.Cmd != cmd {
+			continue
+		}
+		elem := reflect.New(structType)
+		if err := d.Decode(elem.Interface()); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if elemType.Kind() == reflect.Pointer {
+			slice = reflect.Append(slice, elem)
+		} else {
+			slice = reflect.Append(slice, elem.Elem())
+		}
+	}
+	if err := Errors("can not decode directives", errs); err != nil {
+		return err
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+type decodeField struct {
+	name       string
+	index      int
+	required   bool
+	hasDefault bool
+	def        string
+	enum       []string
+}
+
+func parseDecodeFields(typ reflect.Type) ([]decodeField, error) {
+	var fields []decodeField
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		tag := sf.Tag.Get("ggen")
+		if tag == "-" || !sf.IsExported() {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		field := decodeField{name: parts[0], index: i}
+		if field.name == "" {
+			field.name = strings.ToLower(sf.Name)
+		}
+		for _, part := range parts[1:] {
+			switch {
+			case part == "required":
+				field.required = true
+			case strings.HasPrefix(part, "default="):
+				field.hasDefault = true
+				field.def = strings.TrimPrefix(part, "default=")
+			case strings.HasPrefix(part, "enum="):
+				field.enum = strings.Split(strings.TrimPrefix(part, "enum="), "|")
+			default:
+				return nil, Errorf(nil, "field %v: invalid tag option %q", sf.Name, part)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func (d Directive) decode(rv reflect.Value) error {
+	typ := rv.Type()
+	fields, err := parseDecodeFields(typ)
+	if err != nil {
+		return err
+	}
+	kvs, err := d.ParseKV()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, kv := range kvs {
+		idx := -1
+		for i, field := range fields {
+			if field.name == kv.Key {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return &ArgError{Offset: kv.Offset, Msg: "unknown key " + strconv.Quote(kv.Key)}
+		}
+		field := fields[idx]
+		fv := rv.Field(field.index)
+		name := typ.Field(field.index).Name
+		if seen[kv.Key] && fv.Kind() != reflect.Slice {
+			return &ArgError{Offset: kv.Offset, Msg: "duplicated key " + strconv.Quote(kv.Key)}
+		}
+		seen[kv.Key] = true
+
+		value := kv.Value
+		if !kv.HasValue {
+			if fv.Kind() != reflect.Bool {
+				return &ArgError{Offset: kv.Offset, Msg: "missing value of " + strconv.Quote(kv.Key)}
+			}
+			value = "true"
+		}
+		if err = field.set(fv, value); err != nil {
+			return &ArgError{Offset: kv.ValueOffset, Msg: "field " + name + ": " + err.Error()}
+		}
+	}
+
+	for _, field := range fields {
+		if seen[field.name] {
+			continue
+		}
+		name := typ.Field(field.index).Name
+		switch {
+		case field.required:
+			return Errorf(nil, "field %v: missing required key %q", name, field.name)
+		case field.hasDefault:
+			if err = field.set(rv.Field(field.index), field.def); err != nil {
+				return Errorf(err, "field %v: invalid default: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (field decodeField) set(fv reflect.Value, s string) error {
+	if fv.Kind() == reflect.Slice && !fv.Addr().Type().Implements(textUnmarshalerType) {
+		// comma-separated values, appended on repeated keys
+		for _, item := range strings.Split(s, ",") {
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := field.setValue(elem, item); err != nil {
+				return err
+			}
+			fv.Set(reflect.Append(fv, elem))
+		}
+		return nil
+	}
+	return field.setValue(fv, s)
+}
+
+func (field decodeField) setValue(fv reflect.Value, s string) error {
+	if field.enum != nil && !slices.Contains(field.enum, s) {
+		return Errorf(nil, "invalid value %q (expected one of %v)", s, strings.Join(field.enum, ", "))
+	}
+	if u, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	if fv.Type() == durationType {
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			return Errorf(err, "invalid duration %q", s)
+		}
+		fv.SetInt(int64(dur))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return Errorf(err, "invalid bool %q", s)
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, fv.Type().Bits())
+		if err != nil {
+			return Errorf(err, "invalid %v %q", fv.Type(), s)
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, fv.Type().Bits())
+		if err != nil {
+			return Errorf(err, "invalid %v %q", fv.Type(), s)
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return Errorf(err, "invalid %v %q", fv.Type(), s)
+		}
+		fv.SetFloat(n)
+	default:
+		return Errorf(nil, "unsupported type %v", fv.Type())
+	}
+	return nil
+}
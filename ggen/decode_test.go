@@ -0,0 +1,87 @@
+package ggen
+
+import (
+	"go/token"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type decodeArgs struct {
+	Name  string        `ggen:"name,required"`
+	Count int           `ggen:"count,default=10"`
+	Mode  string        `ggen:"mode,enum=fast|safe"`
+	Tags  []string      `ggen:"tags"`
+	Wait  time.Duration `ggen:"wait,default=1s"`
+	Debug bool
+	Skip  string `ggen:"-"`
+}
+
+func TestDecode(t *testing.T) {
+	decode := func(arg string) (decodeArgs, error) {
+		var args decodeArgs
+		err := Directive{Raw: "+gen:sample " + arg, Cmd: "gen:sample", Arg: arg}.Decode(&args)
+		return args, err
+	}
+
+	args, err := decode(`name="Alice M" mode=fast tags=a,b tags:c debug`)
+	require.NoError(t, err)
+	require.Equal(t, decodeArgs{Name: "Alice M", Count: 10, Mode: "fast", Tags: []string{"a", "b", "c"}, Wait: time.Second, Debug: true}, args)
+
+	args, err = decode(`name=Bob count=0x10 wait=5m debug=false`)
+	require.NoError(t, err)
+	require.Equal(t, decodeArgs{Name: "Bob", Count: 16, Wait: 5 * time.Minute}, args)
+
+	for arg, msg := range map[string]string{
+		`count=1`:             `field Name: missing required key "name"`,
+		`name=a count=x`:      `offset 13: field Count: invalid int "x"`,
+		`name=a mode=slow`:    `offset 12: field Mode: invalid value "slow" (expected one of fast, safe)`,
+		`name=a color=red`:    `offset 7: unknown key "color"`,
+		`name=a name=b`:       `offset 7: duplicated key "name"`,
+		`name=a count`:        `offset 7: missing value of "count"`,
+		`name=a skip=true`:    `offset 7: unknown key "skip"`,
+		`name="a`:             `offset 5: unterminated quoted string`,
+		`name=a wait=forever`: `offset 12: field Wait: invalid duration "forever"`,
+	} {
+		_, err = decode(arg)
+		require.EqualError(t, err, "directive +gen:sample "+arg+": "+msg)
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	ds := Directives{
+		{Raw: "+gen:sample name=a", Cmd: "gen:sample", Arg: "name=a"},
+		{Raw: "+gen:other", Cmd: "gen:other"},
+		{Raw: "+gen:sample name=b count=2", Cmd: "gen:sample", Arg: "name=b count=2"},
+	}
+	var args []*decodeArgs
+	require.NoError(t, ds.DecodeAll("gen:sample", &args))
+	require.Len(t, args, 2)
+	require.Equal(t, "a", args[0].Name)
+	require.Equal(t, 2, args[1].Count)
+
+	var values []decodeArgs
+	require.NoError(t, ds.DecodeAll("gen:sample", &values))
+	require.Len(t, values, 2)
+
+	ds = append(ds, Directive{Raw: "+gen:sample", Cmd: "gen:sample"})
+	err := ds.DecodeAll("gen:sample", &values)
+	require.ErrorContains(t, err, `directive +gen:sample: field Name: missing required key "name"`)
+	require.ErrorContains(t, Directives{}.DecodeAll("gen:sample", &decodeArgs{}), "expected a pointer to slice")
+}
+
+func TestDecodePosition(t *testing.T) {
+	d := Directive{
+		Raw:      "+gen:sample name=a count=x",
+		Cmd:      "gen:sample",
+		Arg:      "name=a count=x",
+		Position: token.Position{Filename: "a.go", Line: 3, Column: 4},
+	}
+	var args decodeArgs
+	require.EqualError(t, d.Decode(&args), `a.go:3:29: directive +gen:sample name=a count=x: field Count: invalid int "x"`)
+	require.EqualError(t, d.Errorf("invalid %v", "argument"), "a.go:3:4: invalid argument")
+
+	d.Position = token.Position{}
+	require.EqualError(t, d.Errorf("invalid %v", "argument"), "directive +gen:sample name=a count=x: invalid argument")
+}
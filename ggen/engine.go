@@ -1,14 +1,17 @@
 package ggen
 
 import (
+	"context"
 	"fmt"
 	"go/ast"
 	"go/token"
 	"go/types"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/tools/go/packages"
 )
@@ -56,6 +59,9 @@ type Engine interface {
 	// Plugin should use the embedded logger to log messages.
 	Logger
 
+	// Context returns the context of the run. Long-running plugins should stop when it is done.
+	Context() context.Context
+
 	// GenerateEachPackage loops through the list of GeneratingPackages and call the given function.
 	GenerateEachPackage(func(Engine, *packages.Package, Printer) error) error
 
@@ -65,12 +71,17 @@ type Engine interface {
 	// GeneratePackage generates file at given package path with the given file name. The file name must not include any slash character (/). If fileName is empty, use default file name.
 	GeneratePackage(pkg *packages.Package, fileName string) (Printer, error)
 
-	// GenerateFile generates file at given path. It should be an absolute path, can include slash character (/). If the path ends with /, use default file name.
+	// GenerateFile generates file at given path. It should be an absolute path, can include slash character (/). If the path ends with /, use default file name. An existing file at the path is only overwritten if it was generated by ggen.
 	GenerateFile(pkgName, filePath string) (Printer, error)
 
 	GetComment(Positioner) Comment
 	GetDirectives(Positioner) Directives
 	GetDirectivesByPackage(*packages.Package) Directives
+
+	// GetAllDirectivesByPackage returns the package-level directives, followed by the directives attached to the
+	// declarations of the package (types, funcs, methods, fields, consts and vars) in source order. Directive.Item is
+	// the object owning the directive.
+	GetAllDirectivesByPackage(*packages.Package) Directives
 	GetIdent(Positioner) *ast.Ident
 	GetObject(Positioner) types.Object
 	GetObjectByName(pkgPath, name string) types.Object
@@ -86,20 +97,26 @@ type Engine interface {
 var _ Engine = &wrapEngine{}
 
 type engine struct {
+	ctx    context.Context
 	logger Logger
 
 	plugins        []*pluginStruct
 	enabledPlugins []*pluginStruct
 	pluginsMap     map[string]*pluginStruct
 
-	xcfg    Config
-	xinfo   *extendedInfo
-	pkgcfg  packages.Config
-	pkgMap  map[string]*packages.Package
-	dir2pkg map[string]*packages.Package
-	srcMap  map[string][]byte
-	bufPool *sync.Pool
+	xcfg      Config
+	goimports goimportsOptions
+	xinfo     *extendedInfo
+	pkgcfg    packages.Config
+	pkgMap    map[string]*packages.Package
+	dir2pkg   map[string]*packages.Package
+	srcMap    map[string][]byte
+	bufPool   *sync.Pool
 
+	// loadPatterns are the patterns for loading the packages for generating
+	loadPatterns []string
+
+	availablePkgs          []*packages.Package
 	builtinTypes           map[string]types.Type
 	cleanedFileNames       map[string]bool
 	mapPkgDirectives       map[string][]Directive
@@ -108,6 +125,23 @@ type engine struct {
 	includedPackages       map[string][]bool
 	sortedIncludedPackages []includedPackage
 	generatedFiles         []string
+	previousFiles          map[string][]byte
+	stagedFiles            map[string][]byte
+	outputOwners           map[string]fileOwner
+	hasher                 *inputHasher
+	cache                  *cache
+	manifest               *Manifest
+	manifestFile           string
+	manifestDir            string
+
+	startTime       time.Time
+	timings         Timings
+	pluginDurations map[string]time.Duration
+	warnings        []string
+
+	// onlyPackages restricts cleaning and generating to the given packages, used by Watch for regenerating the
+	// packages affected by a change. Nil means no restriction.
+	onlyPackages map[string]bool
 }
 
 type wrapEngine struct {
@@ -118,16 +152,35 @@ type wrapEngine struct {
 	pkgs   []*GeneratingPackage
 }
 
+func (ng *engine) newWrapEngine(pl *pluginStruct) *wrapEngine {
+	return &wrapEngine{
+		embededLogger: embededLogger{ng.logger.With("plugin", pl.name)},
+		engine:        ng,
+		plugin:        pl,
+	}
+}
+
 func newEngine(logger Logger) *engine {
 	return &engine{
+		ctx:        context.Background(),
 		logger:     logger,
 		pkgMap:     make(map[string]*packages.Package),
 		dir2pkg:    make(map[string]*packages.Package),
 		pluginsMap: make(map[string]*pluginStruct),
 		bufPool:    &sync.Pool{},
+
+		previousFiles: make(map[string][]byte),
+		stagedFiles:   make(map[string][]byte),
+		outputOwners:  make(map[string]fileOwner),
+
+		pluginDurations: make(map[string]time.Duration),
 	}
 }
 
+func (ng *engine) Context() context.Context {
+	return ng.ctx
+}
+
 func (ng *engine) GetComment(p Positioner) Comment {
 	cmt := ng.xinfo.GetComment(ng.GetIdent(p))
 	return cmt
@@ -216,6 +269,9 @@ func (ng *wrapEngine) GenerateEachPackage(
 	fn func(Engine, *packages.Package, Printer) error,
 ) error {
 	for _, pkg := range ng.generatingPackages() {
+		if err := ng.checkContext(); err != nil {
+			return err
+		}
 		prt := pkg.GetPrinter()
 		if err := fn(ng, pkg.Package, prt); err != nil {
 			return Errorf(err, "generating package %v: %v", pkg.PkgPath, err)
@@ -286,7 +342,15 @@ func (ng *wrapEngine) GenerateFile(pkgName string, filePath string) (Printer, er
 	if filePath == "" {
 		return nil, Errorf(nil, "empty file path")
 	}
-	dir := filepath.Dir(filePath)
+	isDir := strings.HasSuffix(filePath, "/")
+	filePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, Errorf(err, "invalid file path %v: %v", filePath, err)
+	}
+	dir := filePath
+	if !isDir {
+		dir = filepath.Dir(filePath)
+	}
 	if pkg0 := ng.dir2pkg[dir]; pkg0 != nil {
 		pkg = pkg0.Types
 		pkgName = pkg0.Name
@@ -295,22 +359,14 @@ func (ng *wrapEngine) GenerateFile(pkgName string, filePath string) (Printer, er
 		return nil, Errorf(nil, "empty package name")
 	}
 
-	if strings.HasSuffix(filePath, "/") {
+	if isDir {
 		fileName := generateFileName(ng.engine, ng.plugin)
 		filePath = filepath.Join(filePath, fileName)
 	}
 	{
-		err := os.MkdirAll(dir, 0755)
+		names, err := readDirNames(dir)
 		if err != nil {
-			return nil, Errorf(err, "create directory %q: %v", dir, err)
-		}
-		file, err := os.Open(dir)
-		if err != nil {
-			return nil, Errorf(err, "can not read dir %q: %v", dir, err)
-		}
-		names, err := file.Readdirnames(-1)
-		if err != nil {
-			return nil, Errorf(err, "can not read dir %q: %v", dir, err)
+			return nil, err
 		}
 		found := false
 		for _, name := range names {
@@ -323,8 +379,7 @@ func (ng *wrapEngine) GenerateFile(pkgName string, filePath string) (Printer, er
 			// create an empty doc.go for working around "can not find module
 			// providing package ..." error
 			docFile := filepath.Join(dir, "doc.go")
-			err = os.WriteFile(docFile, []byte("package "+pkgName), 0644)
-			if err != nil {
+			if err = ng.stageFile(docFile, []byte("package "+pkgName)); err != nil {
 				return nil, Errorf(err, "can not write file %v: %v", docFile, err)
 			}
 		}
@@ -333,6 +388,23 @@ func (ng *wrapEngine) GenerateFile(pkgName string, filePath string) (Printer, er
 	return pr, nil
 }
 
+// readDirNames returns the names of the files in the directory. The directory may not exist yet.
+func readDirNames(dir string) ([]string, error) {
+	file, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, Errorf(err, "can not read dir %q: %v", dir, err)
+	}
+	defer func() { must(file.Close()) }()
+	names, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, Errorf(err, "can not read dir %q: %v", dir, err)
+	}
+	return names, nil
+}
+
 func (ng *wrapEngine) GetDirectivesByPackage(pkg *packages.Package) Directives {
 	directives, ok := ng.engine.mapPkgDirectives[pkg.PkgPath]
 	if !ok {
@@ -347,7 +419,7 @@ func (ng *wrapEngine) GetDirectivesByPackage(pkg *packages.Package) Directives {
 			}
 
 			// only parse package level directives
-			errs := parseDirectivesFromBody(body, &directives, nil)
+			errs := parseDirectivesFromBody(file, body, &directives, nil)
 			for _, err = range errs {
 				ng.Error("invalid directive from file", err, "file", file)
 			}
@@ -357,6 +429,24 @@ func (ng *wrapEngine) GetDirectivesByPackage(pkg *packages.Package) Directives {
 	return cloneDirectives(directives)
 }
 
+func (ng *wrapEngine) GetAllDirectivesByPackage(pkg *packages.Package) Directives {
+	var itemDirectives Directives
+	for _, decl := range ng.engine.xinfo.Declarations {
+		if decl.Pkg == pkg {
+			itemDirectives = append(itemDirectives, decl.Comment.Directives...)
+		}
+	}
+	sort.Slice(itemDirectives, func(i, j int) bool {
+		a, b := itemDirectives[i], itemDirectives[j]
+		if a.Pos != b.Pos {
+			return a.Pos < b.Pos
+		}
+		// a directive shared by several names, like "var a, b int"
+		return a.Item.Pos() < b.Item.Pos()
+	})
+	return append(ng.GetDirectivesByPackage(pkg), itemDirectives...)
+}
+
 func (ng *wrapEngine) LogDebugNode(node ast.Node) error {
 	return ast.Print(ng.engine.xinfo.Fset, node)
 }
@@ -0,0 +1,345 @@
+package ggen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ExternalProtocolVersion is the version of the protocol between ggen and external plugins. It is increased on
+// incompatible changes.
+const ExternalProtocolVersion = 1
+
+// ExternalPluginPrefix is the prefix of the executables of external plugins: plugin foo runs ggen-plugin-foo.
+const ExternalPluginPrefix = "ggen-plugin-"
+
+// ExternalPlugin runs a plugin out of process, so plugins can ship as independent binaries instead of being compiled
+// into ggen. The protocol is similar to protoc plugins: ggen writes an ExternalRequest describing the included packages
+// as JSON to the stdin of the executable, then reads an ExternalResponse with the generated files from its stdout. The
+// files go through the normal printer and import fixing, like the files of other plugins. Stderr is passed through.
+//
+// Packages are included when they have the directive "+gen:<name>", at package level or attached to a declaration.
+// Plugin binaries can use ServeExternalPlugin for implementing the protocol.
+type ExternalPlugin struct {
+	name string
+
+	// Path is the executable. It defaults to ggen-plugin-<name>, looked up in PATH.
+	Path string
+
+	// Args are passed to the executable.
+	Args []string
+
+	// Env is appended to the environment of the executable.
+	Env []string
+}
+
+var _ Plugin = &ExternalPlugin{}
+var _ DirectiveDeclarer = &ExternalPlugin{}
+
+func NewExternalPlugin(name string) *ExternalPlugin {
+	return &ExternalPlugin{name: name}
+}
+
+func (p *ExternalPlugin) Name() string { return p.name }
+
+func (p *ExternalPlugin) Filter(ng FilterEngine) error {
+	return FilterByCommand("gen:" + p.name).FilterAll(ng)
+}
+
+func (p *ExternalPlugin) Directives() []DirectiveSpec {
+	return []DirectiveSpec{{Cmd: "gen:" + p.name}}
+}
+
+func (p *ExternalPlugin) Generate(ng Engine) error {
+	req := newExternalRequest(ng, p.name)
+	if len(req.Packages) == 0 {
+		return nil
+	}
+	resp, err := p.run(ng, req)
+	if err != nil {
+		return err
+	}
+	return writeExternalFiles(ng, resp.Files)
+}
+
+func (p *ExternalPlugin) run(ng Engine, req *ExternalRequest) (*ExternalResponse, error) {
+	path := p.Path
+	if path == "" {
+		var err error
+		path, err = exec.LookPath(ExternalPluginPrefix + p.name)
+		if err != nil {
+			return nil, Errorf(err, "can not find external plugin: %v", err)
+		}
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, Errorf(err, "can not encode request: %v", err)
+	}
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ng.Context(), path, p.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), p.Env...)
+	ng.Debug("run external plugin", "path", path, "packages", len(req.Packages))
+	if err = cmd.Run(); err != nil {
+		return nil, Errorf(err, "external plugin %v: %v", path, err)
+	}
+
+	var resp ExternalResponse
+	if err = json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, Errorf(err, "external plugin %v: invalid response: %v", path, err)
+	}
+	if resp.Error != "" {
+		return nil, Errorf(nil, "external plugin %v: %v", path, resp.Error)
+	}
+	return &resp, nil
+}
+
+// ExternalRequest is sent to external plugins.
+type ExternalRequest struct {
+	Version  int               `json:"version"`
+	Plugin   string            `json:"plugin"`
+	Packages []ExternalPackage `json:"packages"`
+}
+
+// ExternalPackage describes an included package. Types are written with the full package path, like
+// "example.com/foo.Bar".
+type ExternalPackage struct {
+	PkgPath    string              `json:"pkg_path"`
+	Name       string              `json:"name"`
+	Dir        string              `json:"dir"`
+	Directives []ExternalDirective `json:"directives,omitempty"`
+	Objects    []ExternalObject    `json:"objects,omitempty"`
+}
+
+type ExternalDirective struct {
+	Raw string `json:"raw"`
+	Cmd string `json:"cmd"`
+	Arg string `json:"arg,omitempty"`
+
+	// Position is the position of the directive, like "file.go:12:4", for reporting errors at the directive.
+	Position string `json:"position,omitempty"`
+}
+
+// ExternalObject is a package-level declaration. Kind is one of "const", "var", "type" and "func".
+type ExternalObject struct {
+	Name       string              `json:"name"`
+	Kind       string              `json:"kind"`
+	Type       string              `json:"type"`
+	Underlying string              `json:"underlying,omitempty"`
+	Position   string              `json:"position"`
+	Doc        string              `json:"doc,omitempty"`
+	Directives []ExternalDirective `json:"directives,omitempty"`
+	Fields     []ExternalField     `json:"fields,omitempty"`
+	Methods    []ExternalMethod    `json:"methods,omitempty"`
+}
+
+// ExternalField is a field of a struct type.
+type ExternalField struct {
+	Name       string              `json:"name"`
+	Type       string              `json:"type"`
+	Tag        string              `json:"tag,omitempty"`
+	Embedded   bool                `json:"embedded,omitempty"`
+	Position   string              `json:"position"`
+	Doc        string              `json:"doc,omitempty"`
+	Directives []ExternalDirective `json:"directives,omitempty"`
+}
+
+// ExternalMethod is a method declared on a named type, or a method of an interface type.
+type ExternalMethod struct {
+	Name       string              `json:"name"`
+	Signature  string              `json:"signature"`
+	Pointer    bool                `json:"pointer,omitempty"`
+	Position   string              `json:"position"`
+	Doc        string              `json:"doc,omitempty"`
+	Directives []ExternalDirective `json:"directives,omitempty"`
+}
+
+// ExternalResponse is returned by external plugins. A non-empty Error fails the run.
+type ExternalResponse struct {
+	Files []ExternalFile `json:"files,omitempty"`
+	Error string         `json:"error,omitempty"`
+}
+
+// ExternalFile is a generated file in an included package. Body is the code after the import declarations. Missing
+// imports are added automatically, Imports is only needed for aliases or ambiguous paths.
+type ExternalFile struct {
+	PkgPath string `json:"pkg_path"`
+
+	// FileName defaults to the generated file name of the plugin. It must not contain a slash.
+	FileName string           `json:"file_name,omitempty"`
+	Imports  []ExternalImport `json:"imports,omitempty"`
+	Body     string           `json:"body"`
+}
+
+type ExternalImport struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+}
+
+func newExternalRequest(ng Engine, plugin string) *ExternalRequest {
+	req := &ExternalRequest{Version: ExternalProtocolVersion, Plugin: plugin}
+	for _, gpkg := range ng.GeneratingPackages() {
+		epkg := ExternalPackage{
+			PkgPath:    gpkg.PkgPath,
+			Name:       gpkg.Name,
+			Dir:        gpkg.GetDir(),
+			Directives: externalDirectives(gpkg.Fset, gpkg.GetDirectives()),
+		}
+		for _, obj := range gpkg.GetObjects() {
+			epkg.Objects = append(epkg.Objects, newExternalObject(ng, gpkg, obj))
+		}
+		req.Packages = append(req.Packages, epkg)
+	}
+	return req
+}
+
+func newExternalObject(ng Engine, gpkg *GeneratingPackage, obj types.Object) ExternalObject {
+	cmt := ng.GetComment(obj)
+	eobj := ExternalObject{
+		Name:       obj.Name(),
+		Type:       types.TypeString(obj.Type(), nil),
+		Position:   gpkg.Fset.Position(obj.Pos()).String(),
+		Doc:        cmt.Text(),
+		Directives: externalDirectives(gpkg.Fset, cmt.Directives),
+	}
+	switch obj.(type) {
+	case *types.Const:
+		eobj.Kind = "const"
+	case *types.Var:
+		eobj.Kind = "var"
+	case *types.Func:
+		eobj.Kind = "func"
+	case *types.TypeName:
+		eobj.Kind = "type"
+		eobj.Underlying = types.TypeString(obj.Type().Underlying(), nil)
+	}
+	if _, ok := obj.(*types.TypeName); !ok {
+		return eobj
+	}
+
+	switch typ := obj.Type().Underlying().(type) {
+	case *types.Struct:
+		for i := 0; i < typ.NumFields(); i++ {
+			field := typ.Field(i)
+			fieldCmt := ng.GetComment(field)
+			eobj.Fields = append(eobj.Fields, ExternalField{
+				Name:       field.Name(),
+				Type:       types.TypeString(field.Type(), nil),
+				Tag:        typ.Tag(i),
+				Embedded:   field.Embedded(),
+				Position:   gpkg.Fset.Position(field.Pos()).String(),
+				Doc:        fieldCmt.Text(),
+				Directives: externalDirectives(gpkg.Fset, fieldCmt.Directives),
+			})
+		}
+	case *types.Interface:
+		for i := 0; i < typ.NumMethods(); i++ {
+			eobj.Methods = append(eobj.Methods, newExternalMethod(ng, gpkg, typ.Method(i)))
+		}
+	}
+	if named, ok := obj.Type().(*types.Named); ok {
+		for i := 0; i < named.NumMethods(); i++ {
+			eobj.Methods = append(eobj.Methods, newExternalMethod(ng, gpkg, named.Method(i)))
+		}
+	}
+	return eobj
+}
+
+func newExternalMethod(ng Engine, gpkg *GeneratingPackage, fn *types.Func) ExternalMethod {
+	sig := fn.Type().(*types.Signature)
+	pointer := false
+	if recv := sig.Recv(); recv != nil {
+		_, pointer = recv.Type().(*types.Pointer)
+	}
+	cmt := ng.GetComment(fn)
+	return ExternalMethod{
+		Name:       fn.Name(),
+		Signature:  strings.TrimPrefix(types.TypeString(sig, nil), "func"),
+		Pointer:    pointer,
+		Position:   gpkg.Fset.Position(fn.Pos()).String(),
+		Doc:        cmt.Text(),
+		Directives: externalDirectives(gpkg.Fset, cmt.Directives),
+	}
+}
+
+func externalDirectives(fset *token.FileSet, directives []Directive) []ExternalDirective {
+	var result []ExternalDirective
+	for _, d := range directives {
+		ed := ExternalDirective{Raw: d.Raw, Cmd: d.Cmd, Arg: d.Arg}
+		switch {
+		case d.Position.IsValid():
+			ed.Position = d.Position.String()
+		case d.Pos.IsValid():
+			ed.Position = fset.Position(d.Pos).String()
+		}
+		result = append(result, ed)
+	}
+	return result
+}
+
+func writeExternalFiles(ng Engine, files []ExternalFile) error {
+	pkgs := make(map[string]*GeneratingPackage)
+	for _, gpkg := range ng.GeneratingPackages() {
+		pkgs[gpkg.PkgPath] = gpkg
+	}
+	written := make(map[string]bool)
+	for _, file := range files {
+		gpkg := pkgs[file.PkgPath]
+		if gpkg == nil {
+			return Errorf(nil, "file %v: package %v is not included", file.FileName, file.PkgPath)
+		}
+		if file.FileName != "" && (file.FileName != filepath.Base(file.FileName) || !strings.HasSuffix(file.FileName, ".go")) {
+			return Errorf(nil, "invalid file name %q: it must be a .go file name without directory", file.FileName)
+		}
+		prt, err := ng.GeneratePackage(gpkg.Package, file.FileName)
+		if err != nil {
+			return err
+		}
+		if written[prt.FilePath()] {
+			return Errorf(nil, "file %v is returned more than once", prt.FilePath())
+		}
+		written[prt.FilePath()] = true
+		for _, imp := range file.Imports {
+			prt.Import(imp.Name, imp.Path)
+		}
+		if _, err = io.WriteString(prt, file.Body); err != nil {
+			return err
+		}
+		if err = prt.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeExternalPlugin implements the protocol of external plugins: it reads the request from stdin, calls generate,
+// then writes the response to stdout. An error from generate is reported in the response. It is intended to be called
+// from the main function of a ggen-plugin-<name> executable.
+func ServeExternalPlugin(generate func(*ExternalRequest) ([]ExternalFile, error)) error {
+	return serveExternalPlugin(os.Stdin, os.Stdout, generate)
+}
+
+func serveExternalPlugin(r io.Reader, w io.Writer, generate func(*ExternalRequest) ([]ExternalFile, error)) error {
+	var req ExternalRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return Errorf(err, "can not decode request: %v", err)
+	}
+	var resp ExternalResponse
+	if req.Version != ExternalProtocolVersion {
+		resp.Error = fmt.Sprintf("unsupported protocol version %v (expected %v)", req.Version, ExternalProtocolVersion)
+	} else if files, err := generate(&req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Files = files
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -1,6 +1,8 @@
 package ggen
 
 import (
+	"context"
+
 	"golang.org/x/tools/go/packages"
 )
 
@@ -34,6 +36,9 @@ type FilterEngine interface {
 	// Plugin should use the embedded logger to log messages.
 	Logger
 
+	// Context returns the context of the run.
+	Context() context.Context
+
 	// IncludePackage indicates that the given package will be included for generating. It will be returned later in
 	// Engine.GeneratingPackages(). If it does not exist, an error with be returned later.
 	IncludePackage(pkgPath string)
@@ -87,6 +92,10 @@ func (ng *filterEngine) Logger() Logger {
 	return ng.embededLogger
 }
 
+func (ng *filterEngine) Context() context.Context {
+	return ng.ng.ctx
+}
+
 // IncludePackage indicates that the given package will be included for generating. It will be returned later in
 // Engine.GeneratingPackages(). If it does not exist, an error with be returned later.
 func (ng *filterEngine) IncludePackage(pkgPath string) {
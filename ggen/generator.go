@@ -2,51 +2,67 @@ package ggen
 
 import (
 	"bytes"
-	"fmt"
-	"io"
+	"context"
+	"go/token"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
 )
 
-func (ng *engine) start(cfg Config, patterns ...string) (_err error) {
+func (ng *engine) start(ctx context.Context, cfg Config, patterns ...string) (*Result, error) {
+	ng.ctx = ctx
+	ng.logger = ng.logger.WithContext(ctx)
+	ng.startTime = time.Now()
 	{
 		for _, plugin := range cfg.Plugins {
 			if err := ng.registerPlugin(plugin); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 	{
 		if len(patterns) == 0 {
-			return Errorf(nil, "no patterns")
+			return nil, Errorf(nil, "no patterns")
 		}
 		if len(ng.plugins) == 0 {
-			return Errorf(nil, "no registered plugins")
+			return nil, Errorf(nil, "no registered plugins")
 		}
 		if err := ng.validateConfig(&cfg); err != nil {
-			return err
+			return nil, err
 		}
 		ng.xcfg = cfg
+		if err := ng.configurePlugins(); err != nil {
+			return nil, err
+		}
+		if err := ng.initPlugins(); err != nil {
+			return nil, err
+		}
 	}
 	buildFlags := getBuildFlags(cfg.BuildTags)
 	{
 		mode := packages.NeedName | packages.NeedImports | packages.NeedDeps |
 			packages.NeedFiles | packages.NeedCompiledGoFiles
 		ng.pkgcfg = packages.Config{
+			Context:    ctx,
+			Dir:        cfg.Dir,
 			Mode:       mode,
 			BuildFlags: buildFlags,
 		}
+		loadStart := time.Now()
 		pkgs, err := packages.Load(&ng.pkgcfg, patterns...)
 		if err != nil {
-			return Errorf(err, "can not load package: %v", err)
+			return nil, Errorf(err, "can not load package: %v", err)
 		}
+		ng.timings.Load += time.Since(loadStart)
 
 		// populate cleanedFileNames
 		cleanedFileNames := make(map[string]bool)
@@ -55,6 +71,15 @@ func (ng *engine) start(cfg Config, patterns ...string) (_err error) {
 			filename := ng.genFilename(input)
 			cleanedFileNames[filename] = true
 		}
+		ng.cleanedFileNames = cleanedFileNames
+
+		ng.hasher = newInputHasher(pkgs)
+		if err = ng.readManifest(); err != nil {
+			return nil, err
+		}
+		if err = ng.loadCache(); err != nil {
+			return nil, err
+		}
 
 		// list available packages
 		availablePkgs := make([]*packages.Package, 0, len(pkgs))
@@ -65,18 +90,36 @@ func (ng *engine) start(cfg Config, patterns ...string) (_err error) {
 				continue
 			}
 			availablePkgs = append(availablePkgs, pkg)
-			if err = cleanDir(cleanedFileNames, pkgDir); err != nil {
-				return err
+			if ng.onlyPackages != nil && !ng.onlyPackages[pkg.PkgPath] {
+				continue
+			}
+			if err = ng.cleanDir(pkgDir); err != nil {
+				return nil, err
 			}
 		}
-		ng.cleanedFileNames = cleanedFileNames
+		ng.availablePkgs = availablePkgs
+		if err = ng.cleanManifestFiles(); err != nil {
+			return nil, err
+		}
 		if cfg.CleanOnly {
-			return nil
+			return ng.result()
 		}
 
 		// populate collectedPackages, includes, srcMap
+		filterStart := time.Now()
 		if err = ng.collectPackages(availablePkgs); err != nil {
-			return err
+			return nil, err
+		}
+		ng.timings.Filter = time.Since(filterStart)
+		if err = ng.skipFreshPackages(); err != nil {
+			return nil, err
+		}
+		if ng.onlyPackages != nil {
+			for pkgPath, flags := range ng.includedPackages {
+				if !ng.onlyPackages[pkgPath] {
+					clear(flags)
+				}
+			}
 		}
 
 		if ng.logger.Enabled(DebugLevel) {
@@ -96,6 +139,14 @@ func (ng *engine) start(cfg Config, patterns ...string) (_err error) {
 			return sortedIncludedPackages[i].PkgPath < sortedIncludedPackages[j].PkgPath
 		})
 		ng.sortedIncludedPackages = sortedIncludedPackages
+		if ng.onlyPackages != nil && len(sortedIncludedPackages) == 0 {
+			ng.logger.Info("no affected packages for generating")
+			return ng.result()
+		}
+		if ng.cache.allSkipped(sortedIncludedPackages) {
+			ng.logger.Info("all packages are up to date")
+			return ng.result()
+		}
 
 		if ng.logger.Enabled(DebugLevel) {
 			for _, pkg := range sortedIncludedPackages {
@@ -116,90 +167,218 @@ func (ng *engine) start(cfg Config, patterns ...string) (_err error) {
 			}
 		}
 		if len(pkgPatterns) == 0 {
-			fmt.Println("no packages for generating")
-			return nil
+			ng.logger.Info("no packages for generating")
+			return ng.result()
 		}
-		pkgPatterns = append(pkgPatterns, builtinPath) // load builtin types
-
-		ng.pkgcfg = packages.Config{
-			Mode:       packages.LoadAllSyntax,
-			BuildFlags: buildFlags,
-			Overlay:    ng.srcMap,
-		}
-		pkgs, err := packages.Load(&ng.pkgcfg, pkgPatterns...)
-		if err != nil {
-			return Errorf(err, "can not load package: %v", err)
+		ng.loadPatterns = append(pkgPatterns, builtinPath) // load builtin types
+		if err := ng.loadSyntax(ng.srcMap); err != nil {
+			return nil, err
 		}
-
-		// populate xinfo
-		ng.xinfo = newExtendedInfo(ng.pkgcfg.Fset)
-		packages.Visit(pkgs,
-			func(pkg *packages.Package) bool {
-				if cfg.Namespace != "" && !strings.HasPrefix(pkg.PkgPath, cfg.Namespace) {
-					return true
+	}
+	{
+		// populate generatedFiles
+		generateStart, loadTime := time.Now(), ng.timings.Load
+		stages := ng.stages()
+		for i, stage := range stages {
+			if i > 0 {
+				if err := ng.reloadWithOutputs(stages[:i]); err != nil {
+					return nil, err
 				}
-				if err2 := ng.xinfo.AddPackage(pkg); err2 != nil {
-					_err = err2
-					return false
+			}
+			for _, pl := range stage {
+				if err := ng.generatePlugin(pl); err != nil {
+					return nil, err
 				}
-				return true
-			}, nil)
-		if _err != nil {
-			return _err
+			}
 		}
+		ng.timings.Generate = time.Since(generateStart) - (ng.timings.Load - loadTime)
+	}
+	return ng.result()
+}
 
-		// populate pkgMap
-		packages.Visit(pkgs,
-			func(pkg *packages.Package) bool {
-				ng.pkgMap[pkg.PkgPath] = pkg
-				ng.dir2pkg[GetPkgDir(pkg)] = pkg
-				return true
-			}, nil)
-
-		// populate builtin types
-		ng.builtinTypes = parseBuiltinTypes(ng.pkgMap[builtinPath])
-		delete(ng.pkgMap, builtinPath)
+// loadSyntax loads and type-checks the packages for generating, with the given overlay.
+func (ng *engine) loadSyntax(overlay map[string][]byte) error {
+	ng.pkgcfg = packages.Config{
+		Context:    ng.ctx,
+		Dir:        ng.xcfg.Dir,
+		Mode:       packages.LoadAllSyntax,
+		BuildFlags: getBuildFlags(ng.xcfg.BuildTags),
+		Overlay:    overlay,
 	}
-	{
-		// populate generatedFiles
-		for _, pl := range ng.enabledPlugins {
-			wrapNg := &wrapEngine{
-				embededLogger: embededLogger{ng.logger.With("plugin", pl.name)},
-				engine:        ng,
-				plugin:        pl,
+	loadStart := time.Now()
+	pkgs, err := packages.Load(&ng.pkgcfg, ng.loadPatterns...)
+	if err != nil {
+		return Errorf(err, "can not load package: %v", err)
+	}
+
+	// populate xinfo
+	ng.xinfo = newExtendedInfo(ng.pkgcfg.Fset)
+	packages.Visit(pkgs,
+		func(pkg *packages.Package) bool {
+			if ng.xcfg.Namespace != "" && !strings.HasPrefix(pkg.PkgPath, ng.xcfg.Namespace) {
+				return true
 			}
-			if err := pl.plugin.Generate(wrapNg); err != nil {
-				return Errorf(err, "%v: %v", pl.name, err)
+			if err2 := ng.xinfo.AddPackage(pkg); err2 != nil {
+				err = err2
+				return false
 			}
-			for _, gpkg := range wrapNg.pkgs {
-				prt := gpkg.printer
-				if prt != nil && prt.buf.Len() != 0 {
-					// close the printer for writing to file, but only if there
-					// are any bytes written
-					if err := prt.Close(); err != nil {
-						return err
+			return true
+		}, nil)
+	if err != nil {
+		return err
+	}
+
+	// populate pkgMap
+	ng.pkgMap = make(map[string]*packages.Package)
+	ng.dir2pkg = make(map[string]*packages.Package)
+	packages.Visit(pkgs,
+		func(pkg *packages.Package) bool {
+			ng.pkgMap[pkg.PkgPath] = pkg
+			ng.dir2pkg[GetPkgDir(pkg)] = pkg
+			return true
+		}, nil)
+
+	// populate builtin types
+	ng.builtinTypes = parseBuiltinTypes(ng.pkgMap[builtinPath])
+	delete(ng.pkgMap, builtinPath)
+	ng.timings.Load += time.Since(loadStart)
+	return nil
+}
+
+// stages groups the enabled plugins by stage. Without Config.MultiPass, there is a single stage.
+func (ng *engine) stages() [][]*pluginStruct {
+	var stages [][]*pluginStruct
+	for _, pl := range ng.enabledPlugins {
+		for len(stages) <= pl.stage {
+			stages = append(stages, nil)
+		}
+		stages[pl.stage] = append(stages[pl.stage], pl)
+	}
+	return stages
+}
+
+// reloadWithOutputs loads the packages again, with the Go files generated by the plugins of the finished stages in the
+// overlay, so the plugins of the next stage can see them. The "//go:build !ggen" constraint is removed from these
+// files, otherwise they are excluded by the ggen build tag.
+func (ng *engine) reloadWithOutputs(finished [][]*pluginStruct) error {
+	overlay := maps.Clone(ng.srcMap)
+	added := false
+	addFile := func(filePath string, body []byte) {
+		if !strings.HasSuffix(filePath, ".go") {
+			return
+		}
+		overlay[filePath] = bytes.Replace(body, []byte(ggenBuildConstraint), nil, 1)
+		added = true
+	}
+	for _, filePath := range ng.generatedFiles {
+		addFile(filePath, ng.stagedFiles[filePath])
+	}
+	if c := ng.cache; c != nil {
+		for _, stage := range finished {
+			for _, pl := range stage {
+				for key, entry := range c.next {
+					if key.Plugin != pl.name {
+						continue
+					}
+					for filePath := range entry.Outputs {
+						if _, ok := ng.stagedFiles[filePath]; ok {
+							continue
+						}
+						body, err := os.ReadFile(filePath)
+						if err != nil {
+							return Errorf(err, "can not read file %v: %v", filePath, err)
+						}
+						addFile(filePath, body)
 					}
 				}
 			}
 		}
 	}
-	{
-		sort.Strings(ng.generatedFiles)
-		fmt.Println("Generated files:")
-		pwd, err := os.Getwd()
-		must(err)
-		for _, filename := range ng.generatedFiles {
-			filename, err = filepath.Rel(pwd, filename)
-			must(err)
-			fmt.Printf("\t./%v\n", filename)
-		}
-		if err = ng.execGoimport(ng.generatedFiles); err != nil {
-			return err
+	if !added {
+		return nil
+	}
+	ng.logger.Debug("reload packages with generated files", "stage", len(finished)+1)
+	return ng.loadSyntax(overlay)
+}
+
+func (ng *engine) generatePlugin(pl *pluginStruct) error {
+	if (ng.onlyPackages != nil || ng.cache.isPluginSkipped(pl)) && !ng.hasIncludedPackages(pl) {
+		return nil
+	}
+	if err := ng.checkContext(); err != nil {
+		return err
+	}
+	pluginStart := time.Now()
+	wrapNg := ng.newWrapEngine(pl)
+	if err := pl.plugin.Generate(wrapNg); err != nil {
+		return Errorf(err, "%v: %v", pl.name, err)
+	}
+	for _, gpkg := range wrapNg.pkgs {
+		prt := gpkg.printer
+		if prt != nil && prt.buf.Len() != 0 {
+			// close the printer for writing to file, but only if there
+			// are any bytes written
+			if err := prt.Close(); err != nil {
+				return err
+			}
 		}
 	}
+	ng.pluginDurations[pl.name] += time.Since(pluginStart)
 	return nil
 }
 
+// checkContext returns an error if the context of the run is done.
+func (ng *engine) checkContext() error {
+	if err := ng.ctx.Err(); err != nil {
+		return Errorf(err, "generating is cancelled: %v", err)
+	}
+	return nil
+}
+
+func (ng *engine) hasIncludedPackages(pl *pluginStruct) bool {
+	for _, p := range ng.sortedIncludedPackages {
+		if p.Included[pl.index] {
+			return true
+		}
+	}
+	return false
+}
+
+func (ng *engine) result() (*Result, error) {
+	// do not commit a partial run
+	if err := ng.checkContext(); err != nil {
+		return nil, err
+	}
+	if err := ng.findOrphans(); err != nil {
+		return nil, err
+	}
+	changes, err := ng.collectChanges()
+	if err != nil {
+		return nil, err
+	}
+	if !ng.xcfg.DryRun {
+		writeStart := time.Now()
+		if err = ng.commit(changes); err != nil {
+			return nil, err
+		}
+		if err = ng.saveCache(); err != nil {
+			return nil, err
+		}
+		if err = ng.saveManifest(); err != nil {
+			return nil, err
+		}
+		ng.timings.Write = time.Since(writeStart)
+	}
+	result := ng.buildResult(changes)
+	if err = ng.finalizePlugins(result); err != nil {
+		return result, err
+	}
+	if ng.xcfg.Check && len(changes) != 0 {
+		return result, &StaleError{Files: changes}
+	}
+	return result, nil
+}
+
 func (ng *engine) collectPackages(pkgs []*packages.Package) error {
 	collectedPackages, fileContents, err := collectPackages(ng.logger, pkgs, ng.cleanedFileNames)
 	if err != nil {
@@ -208,8 +387,19 @@ func (ng *engine) collectPackages(pkgs []*packages.Package) error {
 	sort.Slice(collectedPackages, func(i, j int) bool {
 		return collectedPackages[i].PkgPath < collectedPackages[j].PkgPath
 	})
+	srcMap := make(map[string][]byte)
+	for _, content := range fileContents {
+		srcMap[content.Path] = content.Body
+	}
+	if err = ng.validateDirectives(pkgs, collectedPackages, srcMap); err != nil {
+		return err
+	}
+
 	pkgMap := map[string][]bool{}
 	for _, pl := range ng.enabledPlugins {
+		if err = ng.checkContext(); err != nil {
+			return err
+		}
 		filterNg := &filterEngine{
 			embededLogger: embededLogger{ng.logger.With("plugin", pl.name)},
 			ng:            ng,
@@ -218,10 +408,13 @@ func (ng *engine) collectPackages(pkgs []*packages.Package) error {
 			pkgMap:        pkgMap,
 			patterns:      &ng.includedPatterns,
 		}
+		pluginStart := time.Now()
 		if err = pl.plugin.Filter(filterNg); err != nil {
 			return Errorf(err, "plugin %v: %v", pl.name, err)
 		}
+		ng.pluginDurations[pl.name] += time.Since(pluginStart)
 	}
+	ng.applyOverrides(pkgs, pkgMap)
 	ng.collectedPackages = collectedPackages
 	ng.includedPackages = pkgMap
 	ng.mapPkgDirectives = make(map[string][]Directive)
@@ -229,14 +422,47 @@ func (ng *engine) collectPackages(pkgs []*packages.Package) error {
 		ng.mapPkgDirectives[pkg.PkgPath] = pkg.Directives
 	}
 
-	srcMap := make(map[string][]byte)
-	for _, content := range fileContents {
-		srcMap[content.Path] = content.Body
-	}
 	ng.srcMap = srcMap
 	return nil
 }
 
+// applyOverrides excludes the packages from the plugins which are not enabled in their directory.
+func (ng *engine) applyOverrides(pkgs []*packages.Package, pkgMap map[string][]bool) {
+	if len(ng.xcfg.Overrides) == 0 {
+		return
+	}
+	for _, pkg := range pkgs {
+		flags := pkgMap[pkg.PkgPath]
+		if flags == nil {
+			continue
+		}
+		o := ng.findOverride(getPackageDir(pkg))
+		if o == nil {
+			continue
+		}
+		for _, pl := range ng.enabledPlugins {
+			if flags[pl.index] && !slices.Contains(o.Plugins, pl.name) {
+				ng.logger.Debug("exclude package by override", "plugin", pl.name, "pkg", pkg.PkgPath, "dir", o.Dir)
+				flags[pl.index] = false
+			}
+		}
+	}
+}
+
+// findOverride returns the innermost override containing the directory.
+func (ng *engine) findOverride(dir string) *DirOverride {
+	var result *DirOverride
+	for i, o := range ng.xcfg.Overrides {
+		if dir != o.Dir && !strings.HasPrefix(dir, o.Dir+string(filepath.Separator)) {
+			continue
+		}
+		if result == nil || len(o.Dir) > len(result.Dir) {
+			result = &ng.xcfg.Overrides[i]
+		}
+	}
+	return result
+}
+
 func getBuildFlags(buildTags []string) []string {
 	var buildFlags = "-tags ggen"
 	if len(buildTags) > 0 {
@@ -303,7 +529,9 @@ func collectPackages(logger Logger, pkgs []*packages.Package, cleanedFileNames m
 	return
 }
 
-func cleanDir(cleanedFileNames map[string]bool, pkgDir string) error {
+// cleanDir marks previously generated files in the package directory for deletion. They are deleted at commit time
+// unless generated again. Files with the same name but without the ggen header are never deleted.
+func (ng *engine) cleanDir(pkgDir string) error {
 	dir, err := os.Open(pkgDir)
 	if err != nil {
 		return err
@@ -314,10 +542,16 @@ func cleanDir(cleanedFileNames map[string]bool, pkgDir string) error {
 		return err
 	}
 	for _, name := range names {
-		if cleanedFileNames[name] {
+		if ng.cleanedFileNames[name] {
 			absFileName := filepath.Join(pkgDir, name)
-			if err = os.Remove(absFileName); err != nil {
-				return Errorf(err, "can not remove file %v: %v", absFileName, err)
+			if ng.cache.isFreshFile(absFileName) {
+				continue
+			}
+			if err = ng.rememberPreviousFile(absFileName); err != nil {
+				return err
+			}
+			if err = ng.checkGeneratedFile(absFileName, "delete"); err != nil {
+				return err
 			}
 		}
 	}
@@ -335,7 +569,7 @@ func parseDirectivesFromPackage(logger Logger, fileCh chan<- fileContent, pkg *p
 		}
 		fileCh <- fileContent{Path: file, Body: body}
 
-		errs := parseDirectivesFromBody(body, &directives, &inlineDirectives)
+		errs := parseDirectivesFromBody(file, body, &directives, &inlineDirectives)
 		if len(errs) != 0 {
 			// ignore unknown directives
 			for _, e := range errs {
@@ -358,7 +592,8 @@ func maxStr(s string) string {
 	return s[:idx]
 }
 
-func parseDirectivesFromBody(body []byte, directives, inlineDirectives *[]Directive) (errs []error) {
+// parseDirectivesFromBody parses the directives of a file. The filename is only used for the positions.
+func parseDirectivesFromBody(filename string, body []byte, directives, inlineDirectives *[]Directive) (errs []error) {
 
 	// store processing directives
 	var tmp []Directive
@@ -366,21 +601,36 @@ func parseDirectivesFromBody(body []byte, directives, inlineDirectives *[]Direct
 	if bytes.HasPrefix(body, startDirective0) || bytes.HasPrefix(body, startDirective1) || bytes.HasPrefix(body, startDirective2) {
 		lastIdx = 0
 	}
-	for idx := 0; idx < len(body); idx++ {
-		if body[idx] != '\n' {
-			continue
+	lineNo := 1
+	for idx := 0; idx < len(body); idx, lineNo = idx+1, lineNo+1 {
+		for idx < len(body) && body[idx] != '\n' {
+			idx++
+		}
+		if idx == len(body) {
+			break
 		}
 
 		// process the last found directive
 		if lastIdx >= 0 {
-			line := body[lastIdx:idx]
+			lineStart := lastIdx
+			if body[lineStart] == '\n' {
+				lineStart++
+			}
+			line := string(body[lineStart:idx])
 			lastIdx = -1
 
-			directive, err := ParseDirective(string(line))
+			directive, err := ParseDirective(line)
 			if err != nil {
 				errs = append(errs, err)
 				continue
 			}
+			column := directiveOffset(line) + 1
+			directive.Position = token.Position{
+				Filename: filename,
+				Offset:   lineStart + column - 1,
+				Line:     lineNo,
+				Column:   column,
+			}
 			tmp = append(tmp, directive)
 		}
 		// directives are followed by a blank line, accept them
@@ -412,24 +662,57 @@ func (ng *engine) validateConfig(cfg *Config) (_err error) {
 	}()
 
 	// populate enabledPlugins
+	var enabledPlugins []*pluginStruct
 	if cfg.EnabledPlugins != nil {
-		for name, enabled := range cfg.EnabledPlugins {
-			if enabled {
-				pl := ng.pluginsMap[name]
-				if pl == nil {
-					return Errorf(nil, "plugin %v not found", name)
-				}
-				pl.enabled = true
-				ng.enabledPlugins = append(ng.enabledPlugins, pl)
+		for _, name := range enabledPluginNames(cfg) {
+			pl := ng.pluginsMap[name]
+			if pl == nil {
+				return Errorf(nil, "plugin %v not found", name)
 			}
+			enabledPlugins = append(enabledPlugins, pl)
 		}
 	} else {
 		// enable all plugins
-		for _, pl := range ng.plugins {
-			pl.enabled = true
+		enabledPlugins = ng.plugins
+	}
+	enabledPlugins, err := ng.sortPlugins(enabledPlugins)
+	if err != nil {
+		return err
+	}
+	for _, pl := range enabledPlugins {
+		pl.enabled = true
+		if cfg.MultiPass {
+			// run after the stages of the dependencies
+			for _, dep := range pl.dependsOn {
+				pl.stage = max(pl.stage, ng.pluginsMap[dep].stage+1)
+			}
 		}
-		ng.enabledPlugins = ng.plugins
 	}
+	ng.enabledPlugins = enabledPlugins
+
+	if cfg.Check {
+		cfg.DryRun = true
+	}
+
+	cfg.Overrides = slices.Clone(cfg.Overrides)
+	for i, o := range cfg.Overrides {
+		for _, plName := range o.Plugins {
+			if ng.pluginsMap[plName] == nil {
+				return Errorf(nil, "override of %v: plugin %v not found", o.Dir, plName)
+			}
+		}
+		dir, err := filepath.Abs(o.Dir)
+		if err != nil {
+			return Errorf(err, "override of %v: %v", o.Dir, err)
+		}
+		cfg.Overrides[i].Dir = dir
+	}
+
+	goimports, err := parseGoimportsArgs(cfg.GoimportsArgs)
+	if err != nil {
+		return err
+	}
+	ng.goimports = goimports
 
 	if cfg.GenerateFileName == nil {
 		cfg.GenerateFileName = defaultFileNameGenerator(defaultGeneratedFileNameTpl)
@@ -443,29 +726,79 @@ func (ng *engine) validateConfig(cfg *Config) (_err error) {
 	return nil
 }
 
+// enabledPluginNames returns the enabled plugins in the order of EnablePlugin calls, then the others sorted by name.
+func enabledPluginNames(cfg *Config) []string {
+	var names, others []string
+	seen := map[string]bool{}
+	for _, name := range cfg.pluginOrder {
+		if cfg.EnabledPlugins[name] && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name, enabled := range cfg.EnabledPlugins {
+		if enabled && !seen[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
 func (ng *engine) genFilename(input GenerateFileNameInput) string {
 	return ng.xcfg.GenerateFileName(input)
 }
 
-func (ng *engine) writeFile(filePath string) (io.WriteCloser, error) {
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return nil, err
-	}
-	ng.generatedFiles = append(ng.generatedFiles, filePath)
-	return f, nil
+// importsMu guards imports.LocalPrefix, which is a package variable, when engines run concurrently.
+var importsMu sync.Mutex
+
+// formatSource runs goimports in-process on the source of a generated file. The imports are resolved as if the file is
+// at filePath.
+func (ng *engine) formatSource(filePath string, src []byte) ([]byte, error) {
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	imports.LocalPrefix = ng.goimports.localPrefix
+	return imports.Process(filePath, src, &ng.goimports.Options)
 }
 
-func (ng *engine) execGoimport(files []string) error {
-	var args []string
-	args = append(args, ng.xcfg.GoimportsArgs...)
-	args = append(args, "-w")
-	args = append(args, files...)
-	cmd := exec.Command("goimports", args...)
-	ng.logger.Debug("goimports", "args", args)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return Errorf(err, "goimports: %s\n\n%s\n", err, out)
+type goimportsOptions struct {
+	imports.Options
+
+	localPrefix string
+}
+
+// hashStrings returns the options that change the formatted files, for the input hash of the cache.
+func (o goimportsOptions) hashStrings() []string {
+	return []string{"goimports", o.localPrefix, strconv.FormatBool(o.FormatOnly)}
+}
+
+// parseGoimportsArgs maps goimports command line flags to the equivalent in-process options.
+func parseGoimportsArgs(args []string) (opts goimportsOptions, _ error) {
+	opts.Options = imports.Options{
+		Comments:  true,
+		TabIndent: true,
+		TabWidth:  8,
 	}
-	return nil
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		switch name {
+		case "local":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return opts, Errorf(nil, "goimports: missing value for %v", arg)
+				}
+				i++
+				value = args[i]
+			}
+			opts.localPrefix = value
+		case "format-only":
+			opts.FormatOnly = !hasValue || value == "true"
+		case "e":
+			opts.AllErrors = !hasValue || value == "true"
+		default:
+			return opts, Errorf(nil, "goimports: unsupported argument %v (supported: -local, -format-only, -e)", arg)
+		}
+	}
+	return opts, nil
 }
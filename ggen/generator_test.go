@@ -1,6 +1,7 @@
 package ggen
 
 import (
+	"go/token"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -13,15 +14,16 @@ func TestParseDirectivesFromBody(t *testing.T) {
 package main
 `
 		var directives, inlineDirectives []Directive
-		errs := parseDirectivesFromBody([]byte(body), &directives, &inlineDirectives)
+		errs := parseDirectivesFromBody("main.go", []byte(body), &directives, &inlineDirectives)
 
 		require.Len(t, errs, 0)
 		require.Len(t, directives, 1)
 		require.Len(t, inlineDirectives, 0)
 		require.Equal(t, Directive{
-			Raw: "go:build tag1,tag2",
-			Cmd: "go:build",
-			Arg: "tag1,tag2",
+			Raw:      "go:build tag1,tag2",
+			Cmd:      "go:build",
+			Arg:      "tag1,tag2",
+			Position: token.Position{Filename: "main.go", Offset: 2, Line: 1, Column: 3},
 		}, directives[0])
 	})
 
@@ -32,15 +34,44 @@ package main
 //+sample
 `
 		var directives, inlineDirectives []Directive
-		errs := parseDirectivesFromBody([]byte(body), &directives, &inlineDirectives)
+		errs := parseDirectivesFromBody("main.go", []byte(body), &directives, &inlineDirectives)
 
 		require.Len(t, errs, 0)
 		require.Len(t, directives, 1)
 		require.Len(t, inlineDirectives, 0)
 		require.Equal(t, Directive{
-			Raw: "+sample",
-			Cmd: "sample",
-			Arg: "",
+			Raw:      "+sample",
+			Cmd:      "sample",
+			Arg:      "",
+			Position: token.Position{Filename: "main.go", Offset: 17, Line: 4, Column: 3},
 		}, directives[0])
 	})
 }
+
+func TestParseGoimportsArgs(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		opts, err := parseGoimportsArgs(nil)
+		require.NoError(t, err)
+		require.True(t, opts.Comments)
+		require.True(t, opts.TabIndent)
+		require.Equal(t, "", opts.localPrefix)
+	})
+	t.Run("local", func(t *testing.T) {
+		opts, err := parseGoimportsArgs([]string{"-local", "github.com/foo", "-format-only"})
+		require.NoError(t, err)
+		require.Equal(t, "github.com/foo", opts.localPrefix)
+		require.True(t, opts.FormatOnly)
+
+		opts, err = parseGoimportsArgs([]string{"--local=github.com/bar"})
+		require.NoError(t, err)
+		require.Equal(t, "github.com/bar", opts.localPrefix)
+	})
+	t.Run("missing value", func(t *testing.T) {
+		_, err := parseGoimportsArgs([]string{"-local"})
+		require.Error(t, err)
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := parseGoimportsArgs([]string{"-w"})
+		require.ErrorContains(t, err, "unsupported argument -w")
+	})
+}
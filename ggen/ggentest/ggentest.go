@@ -0,0 +1,173 @@
+// Package ggentest provides golden-file testing for ggen plugins.
+//
+// A test case is a txtar archive describing a throwaway module, with a go.mod and the sources:
+//
+//	-- go.mod --
+//	module example.com/sample
+//
+//	go 1.21
+//	-- a/a.go --
+//	package a
+//
+//	// +gen:sample
+//
+// Run extracts the archive into a temporary directory, runs the plugins on all packages of the module, then compares
+// the generated files with the golden archive next to it: testdata/sample.txtar is compared with
+// testdata/sample.golden. Run the tests with -update (or GGEN_UPDATE=1) to rewrite the golden archives.
+//
+// The module can only import the standard library, because it is loaded without network access to dependencies.
+package ggentest
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/tools/txtar"
+
+	"github.com/iolivernguyen/ggen/ggen"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of ggentest")
+
+// shouldUpdate reports whether the golden files are rewritten instead of compared. GGEN_UPDATE=1 also works with
+// go test ./..., where -update fails in the packages that do not import ggentest.
+func shouldUpdate() bool {
+	return *update || os.Getenv("GGEN_UPDATE") == "1"
+}
+
+// Run runs the plugins on the module described by the txtar archive and compares the generated files with the golden
+// archive.
+func Run(t testing.TB, archivePath string, plugins ...ggen.Plugin) {
+	t.Helper()
+	cfg := ggen.Config{}
+	cfg.RegisterPlugin(plugins...)
+	RunConfig(t, archivePath, cfg)
+}
+
+// RunConfig is like Run, but with a custom config. Dir and Output are overridden.
+func RunConfig(t testing.TB, archivePath string, cfg ggen.Config) {
+	t.Helper()
+	generated := Generate(t, archivePath, cfg)
+	goldenPath := GoldenPath(archivePath)
+	if shouldUpdate() {
+		if err := os.WriteFile(goldenPath, txtar.Format(generated), 0644); err != nil {
+			t.Fatalf("can not update golden file: %v", err)
+		}
+		return
+	}
+	golden, err := txtar.ParseFile(goldenPath)
+	if err != nil {
+		t.Fatalf("can not read golden file (run with -update to create it): %v", err)
+	}
+	compare(t, goldenPath, golden, generated)
+}
+
+// Generate extracts the txtar archive into a temporary module, runs ggen on all of its packages, and returns the
+// generated files in an archive, with paths relative to the module root, sorted by path.
+func Generate(t testing.TB, archivePath string, cfg ggen.Config) *txtar.Archive {
+	t.Helper()
+	archive, err := txtar.ParseFile(archivePath)
+	if err != nil {
+		t.Fatalf("can not read archive: %v", err)
+	}
+	dir := t.TempDir()
+	if err = extract(dir, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	output := ggen.NewMemFS()
+	cfg.Dir = dir
+	cfg.Output = output
+	if _, err = ggen.Start(cfg, "./..."); err != nil {
+		t.Fatalf("generating %v: %+v", archivePath, err)
+	}
+
+	result := &txtar.Archive{}
+	for _, filePath := range output.Files() {
+		body, err := output.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result.Files = append(result.Files, txtar.File{Name: filepath.ToSlash(rel), Data: body})
+	}
+	return result
+}
+
+// GoldenPath returns the path of the golden archive for the given archive.
+func GoldenPath(archivePath string) string {
+	return strings.TrimSuffix(archivePath, filepath.Ext(archivePath)) + ".golden"
+}
+
+func extract(dir string, archive *txtar.Archive) error {
+	hasGoMod := false
+	for _, file := range archive.Files {
+		name := filepath.FromSlash(file.Name)
+		if !filepath.IsLocal(name) {
+			return ggen.Errorf(nil, "invalid file name %q in archive", file.Name)
+		}
+		if name == "go.mod" {
+			hasGoMod = true
+		}
+		filePath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filePath, file.Data, 0644); err != nil {
+			return err
+		}
+	}
+	if !hasGoMod {
+		return ggen.Errorf(nil, "the archive must contain a go.mod")
+	}
+	return nil
+}
+
+func compare(t testing.TB, goldenPath string, golden, generated *txtar.Archive) {
+	t.Helper()
+	want := make(map[string][]byte)
+	for _, file := range golden.Files {
+		want[file.Name] = file.Data
+	}
+	got := make(map[string][]byte)
+	for _, file := range generated.Files {
+		got[file.Name] = file.Data
+	}
+	names := make([]string, 0, len(want)+len(got))
+	for name := range want {
+		names = append(names, name)
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		wantBody, inGolden := want[name]
+		gotBody, isGenerated := got[name]
+		switch {
+		case !isGenerated:
+			t.Errorf("%v: %v is not generated", goldenPath, name)
+		case !inGolden:
+			t.Errorf("%v: unexpected generated file %v", goldenPath, name)
+		case string(wantBody) != string(gotBody):
+			diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        difflib.SplitLines(string(wantBody)),
+				B:        difflib.SplitLines(string(gotBody)),
+				FromFile: "golden/" + name,
+				ToFile:   "generated/" + name,
+				Context:  3,
+			})
+			t.Errorf("%v: %v is different (run with -update to rewrite):\n%v", goldenPath, name, diff)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ggentest
+
+import (
+	"fmt"
+	"go/types"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iolivernguyen/ggen/ggen"
+)
+
+type namesPlugin struct{}
+
+func (namesPlugin) Name() string { return "names" }
+
+func (namesPlugin) Filter(ng ggen.FilterEngine) error {
+	for _, pkg := range ng.ParsingPackages() {
+		for _, d := range pkg.Directives {
+			if d.Cmd == "gen:names" {
+				pkg.Include()
+			}
+		}
+	}
+	return nil
+}
+
+func (namesPlugin) Generate(ng ggen.Engine) error {
+	for _, pkg := range ng.GeneratingPackages() {
+		p := pkg.GetPrinter()
+		mustPrint(p, "func Names() []string {\n\treturn []string{\n")
+		for _, obj := range pkg.GetObjects() {
+			if _, ok := obj.(*types.TypeName); ok {
+				mustPrint(p, fmt.Sprintf("\t\t%q,\n", obj.Name()))
+			}
+		}
+		mustPrint(p, "\t}\n}\n")
+	}
+	return nil
+}
+
+func mustPrint(p ggen.Printer, s string) {
+	if _, err := p.Write([]byte(s)); err != nil {
+		panic(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	Run(t, filepath.Join("testdata", "names.txtar"), namesPlugin{})
+}
+
+func TestGenerate(t *testing.T) {
+	generated := Generate(t, filepath.Join("testdata", "names.txtar"), configWith(namesPlugin{}))
+	require.Len(t, generated.Files, 1)
+	require.Equal(t, "a/zz_generated.names.go", generated.Files[0].Name)
+	require.Contains(t, string(generated.Files[0].Data), `"Foo",`)
+}
+
+func TestTemplatePlugin(t *testing.T) {
+	pl, err := ggen.LoadTemplatePlugin(filepath.Join("testdata", "describe.ggen.tmpl"))
+	require.NoError(t, err)
+	require.Equal(t, "describe", pl.Name())
+	require.Equal(t, "gen:describe", pl.Command())
+	Run(t, filepath.Join("testdata", "describe.txtar"), pl)
+}
+
+func configWith(plugins ...ggen.Plugin) ggen.Config {
+	cfg := ggen.Config{}
+	cfg.RegisterPlugin(plugins...)
+	return cfg
+}
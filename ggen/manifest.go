@@ -0,0 +1,216 @@
+package ggen
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Manifest lists every file generated by ggen. It is written to Config.ManifestFile after each run, and read at the
+// beginning of the next run for cleaning previously generated files, detecting orphans and invalidating the cache,
+// without scanning directories. Tools can also use it to tell generated files from hand-written ones.
+type Manifest struct {
+	Files []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	// Path is relative to the directory of the manifest, using slashes.
+	Path string `json:"path"`
+
+	Plugin  string `json:"plugin"`
+	Package string `json:"package,omitempty"`
+
+	// InputHash is the hash of the plugin, its version, and the sources of the package and its dependencies. It is
+	// empty if the package was not loaded from the patterns.
+	InputHash string `json:"input_hash,omitempty"`
+
+	// OutputHash is the SHA-256 of the file content.
+	OutputHash string `json:"output_hash"`
+}
+
+// ReadManifest reads a manifest written by a previous run.
+func ReadManifest(path string) (*Manifest, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(body, &m); err != nil {
+		return nil, Errorf(err, "invalid manifest %v: %v", path, err)
+	}
+	return &m, nil
+}
+
+// fileOwner records which plugin and package produced a generated file.
+type fileOwner struct {
+	plugin  *pluginStruct
+	pkgPath string
+}
+
+func (ng *engine) recordOutput(pl *pluginStruct, pkgPath, filePath string) {
+	ng.outputOwners[filePath] = fileOwner{plugin: pl, pkgPath: pkgPath}
+	ng.cache.recordOutput(pl, pkgPath, filePath)
+}
+
+func (ng *engine) readManifest() error {
+	if ng.xcfg.ManifestFile == "" {
+		return nil
+	}
+	manifestFile, err := filepath.Abs(ng.xcfg.ManifestFile)
+	if err != nil {
+		return Errorf(err, "invalid manifest path %v: %v", ng.xcfg.ManifestFile, err)
+	}
+	ng.manifestFile = manifestFile
+	ng.manifestDir = filepath.Dir(manifestFile)
+	m, err := ReadManifest(manifestFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	ng.manifest = m
+	return nil
+}
+
+func (ng *engine) manifestPath(path string) string {
+	return filepath.Join(ng.manifestDir, filepath.FromSlash(path))
+}
+
+// manifestCacheEntries converts the manifest files to cache entries, for using the manifest as the cache when there is
+// no cache file.
+func (ng *engine) manifestCacheEntries() []*cacheEntry {
+	if ng.manifest == nil {
+		return nil
+	}
+	entries := make(map[cacheKey]*cacheEntry)
+	var result []*cacheEntry
+	for _, file := range ng.manifest.Files {
+		if file.InputHash == "" || file.Package == "" {
+			continue
+		}
+		key := cacheKey{Plugin: file.Plugin, PkgPath: file.Package}
+		entry := entries[key]
+		if entry == nil {
+			entry = &cacheEntry{Plugin: file.Plugin, PkgPath: file.Package, InputHash: file.InputHash}
+			entry.Outputs = make(map[string]string)
+			entries[key] = entry
+			result = append(result, entry)
+		}
+		entry.Outputs[ng.manifestPath(file.Path)] = file.OutputHash
+	}
+	return result
+}
+
+// cleanManifestFiles marks the files generated by enabled plugins in the previous run for deletion, like cleanDir. They
+// are deleted at commit time unless generated again. Files of packages that are not loaded from the patterns are kept,
+// so running on a narrower pattern does not delete the files of other packages.
+func (ng *engine) cleanManifestFiles() error {
+	if ng.manifest == nil {
+		return nil
+	}
+	loadedPkgs := make(map[string]bool, len(ng.availablePkgs))
+	for _, pkg := range ng.availablePkgs {
+		loadedPkgs[pkg.PkgPath] = true
+	}
+	for _, file := range ng.manifest.Files {
+		pl := ng.pluginsMap[file.Plugin]
+		if pl == nil || !pl.enabled {
+			continue
+		}
+		if file.Package != "" && !loadedPkgs[file.Package] {
+			continue
+		}
+		if ng.onlyPackages != nil && !ng.onlyPackages[file.Package] {
+			continue
+		}
+		filePath := ng.manifestPath(file.Path)
+		if ng.cache.isFreshFile(filePath) {
+			continue
+		}
+		if err := ng.rememberPreviousFile(filePath); err != nil {
+			return err
+		}
+		if err := ng.checkGeneratedFile(filePath, "delete"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findManifestOrphans reports the files of unregistered plugins from the manifest.
+func (ng *engine) findManifestOrphans() error {
+	for _, file := range ng.manifest.Files {
+		if ng.pluginsMap[file.Plugin] != nil {
+			continue
+		}
+		filePath := ng.manifestPath(file.Path)
+		if _, ok := ng.previousFiles[filePath]; ok {
+			continue
+		}
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			continue
+		}
+		plugin, ok, err := readGeneratedHeader(filePath)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = ng.handleOrphan(filePath, plugin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveManifest writes the files generated in this run, and keeps the files from the previous manifest that are
+// untouched: files of disabled plugins, files of packages that are not loaded, unchanged cached files and orphans that
+// are not removed.
+func (ng *engine) saveManifest() error {
+	if ng.xcfg.ManifestFile == "" {
+		return nil
+	}
+	var m Manifest
+	for filePath, owner := range ng.outputOwners {
+		rel, err := filepath.Rel(ng.manifestDir, filePath)
+		if err != nil {
+			return Errorf(err, "can not record %v in manifest: %v", filePath, err)
+		}
+		file := ManifestFile{
+			Path:       filepath.ToSlash(rel),
+			Plugin:     owner.plugin.name,
+			Package:    owner.pkgPath,
+			OutputHash: hashBytes(ng.stagedFiles[filePath]),
+		}
+		if owner.pkgPath != "" {
+			file.InputHash, _ = ng.inputHash(owner.plugin, owner.pkgPath)
+		}
+		m.Files = append(m.Files, file)
+	}
+	if ng.manifest != nil {
+		for _, file := range ng.manifest.Files {
+			filePath := ng.manifestPath(file.Path)
+			if _, ok := ng.stagedFiles[filePath]; ok {
+				continue
+			}
+			if _, ok := ng.previousFiles[filePath]; ok {
+				continue // deleted
+			}
+			if _, err := os.Stat(filePath); err != nil {
+				continue
+			}
+			m.Files = append(m.Files, file)
+		}
+	}
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+	body, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return Errorf(err, "can not encode manifest: %v", err)
+	}
+	return ng.writeOutput(ng.manifestFile, append(body, '\n'))
+}
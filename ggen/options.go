@@ -0,0 +1,234 @@
+package ggen
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configurable is an optional interface for plugins that accept options. The options come from Config.PluginOptions,
+// which is populated by the -opt flag (-opt plugin.key=value) and the options section of the config file.
+type Configurable interface {
+
+	// Options declares the accepted options. Unknown keys are rejected before Configure is called.
+	Options() []Option
+
+	// Configure receives the parsed options before Filter. It is called once per run, even when no option is set.
+	Configure(Options) error
+}
+
+type OptionType int
+
+const (
+	OptionString OptionType = iota
+	OptionBool
+	OptionInt
+	OptionDuration
+)
+
+func (t OptionType) String() string {
+	switch t {
+	case OptionString:
+		return "string"
+	case OptionBool:
+		return "bool"
+	case OptionInt:
+		return "int"
+	case OptionDuration:
+		return "duration"
+	default:
+		return "unknown"
+	}
+}
+
+// Option describes an option of a Configurable plugin.
+type Option struct {
+	Name  string
+	Type  OptionType
+	Usage string
+
+	// Default is used when the option is not set. It must be valid for the type, otherwise the run fails before
+	// Configure is called.
+	Default string
+}
+
+// Options are the typed values of the options of a plugin. Getting an option which is not declared, or with another
+// type, panics.
+type Options struct {
+	plugin   string
+	defs     map[string]Option
+	values   map[string]any
+	defaults map[string]any
+}
+
+// IsSet reports whether the option is set explicitly, instead of using the default value.
+func (o Options) IsSet(name string) bool {
+	o.def(name)
+	_, ok := o.values[name]
+	return ok
+}
+
+func (o Options) String(name string) string { return o.get(name, OptionString).(string) }
+
+func (o Options) Bool(name string) bool { return o.get(name, OptionBool).(bool) }
+
+func (o Options) Int(name string) int { return o.get(name, OptionInt).(int) }
+
+func (o Options) Duration(name string) time.Duration {
+	return o.get(name, OptionDuration).(time.Duration)
+}
+
+func (o Options) get(name string, typ OptionType) any {
+	def := o.def(name)
+	if def.Type != typ {
+		panic(fmt.Sprintf("plugin %v: option %v is %v, not %v", o.plugin, name, def.Type, typ))
+	}
+	if value, ok := o.values[name]; ok {
+		return value
+	}
+	return o.defaults[name]
+}
+
+// hashStrings returns the resolved options as sorted name=value pairs, for the input hash of the cache.
+func (o Options) hashStrings() []string {
+	names := make([]string, 0, len(o.defs))
+	for name := range o.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value, ok := o.values[name]
+		if !ok {
+			value = o.defaults[name]
+		}
+		pairs[i] = fmt.Sprintf("%v=%v", name, value)
+	}
+	return pairs
+}
+
+func (o Options) def(name string) Option {
+	def, ok := o.defs[name]
+	if !ok {
+		panic(fmt.Sprintf("plugin %v: option %v is not declared", o.plugin, name))
+	}
+	return def
+}
+
+func parseOption(def Option, s string) (any, error) {
+	switch def.Type {
+	case OptionString:
+		return s, nil
+	case OptionBool:
+		if s == "" {
+			return false, nil
+		}
+		return strconv.ParseBool(s)
+	case OptionInt:
+		if s == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(s)
+	case OptionDuration:
+		if s == "" {
+			return time.Duration(0), nil
+		}
+		return time.ParseDuration(s)
+	default:
+		return nil, Errorf(nil, "unknown type %v", def.Type)
+	}
+}
+
+// parseOptions validates the declarations and the raw options of a plugin.
+func parseOptions(pl *pluginStruct, raw map[string]string) (Options, []error) {
+	opts := Options{plugin: pl.name, defs: map[string]Option{}, values: map[string]any{}, defaults: map[string]any{}}
+	c, ok := pl.plugin.(Configurable)
+	if !ok {
+		if len(raw) == 0 {
+			return opts, nil
+		}
+		return opts, []error{Errorf(nil, "plugin %v does not accept options", pl.name)}
+	}
+	var errs []error
+	for _, def := range c.Options() {
+		opts.defs[def.Name] = def
+		value, err := parseOption(def, def.Default)
+		if err != nil {
+			errs = append(errs, Errorf(err, "plugin %v: invalid default %q of option %v: %v", pl.name, def.Default, def.Name, err))
+			continue
+		}
+		opts.defaults[def.Name] = value
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		def, ok := opts.defs[key]
+		if !ok {
+			errs = append(errs, Errorf(nil, "plugin %v: unknown option %q (available: %v)", pl.name, key, strings.Join(optionNames(c), ", ")))
+			continue
+		}
+		value, err := parseOption(def, raw[key])
+		if err != nil {
+			errs = append(errs, Errorf(err, "plugin %v: invalid %v value %q for option %v", pl.name, def.Type, raw[key], key))
+			continue
+		}
+		opts.values[key] = value
+	}
+	return opts, errs
+}
+
+func optionNames(c Configurable) []string {
+	var names []string
+	for _, def := range c.Options() {
+		names = append(names, def.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configurePlugins validates the options of all registered plugins, then configures the enabled plugins.
+func (ng *engine) configurePlugins() error {
+	var errs []error
+	for plName := range ng.xcfg.PluginOptions {
+		if ng.pluginsMap[plName] == nil {
+			errs = append(errs, Errorf(nil, "options of plugin %v: plugin not found", plName))
+		}
+	}
+	for _, pl := range ng.plugins {
+		opts, plErrs := parseOptions(pl, ng.xcfg.PluginOptions[pl.name])
+		errs = append(errs, plErrs...)
+		pl.options = opts
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	if err := Errors("invalid plugin options", errs); err != nil {
+		return err
+	}
+	for _, pl := range ng.enabledPlugins {
+		c, ok := pl.plugin.(Configurable)
+		if !ok {
+			continue
+		}
+		if err := c.Configure(pl.options); err != nil {
+			return Errorf(err, "configure plugin %v: %v", pl.name, err)
+		}
+	}
+	return nil
+}
+
+// ParseOptionFlag parses a plugin option in the form plugin.key=value, as passed to the -opt flag.
+func ParseOptionFlag(s string) (plugin, key, value string, _ error) {
+	name, value, ok := strings.Cut(s, "=")
+	if ok {
+		plugin, key, ok = strings.Cut(name, ".")
+	}
+	if !ok || plugin == "" || key == "" {
+		return "", "", "", Errorf(nil, "invalid option %q (expected plugin.key=value)", s)
+	}
+	return plugin, key, value, nil
+}
@@ -0,0 +1,84 @@
+package ggen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type configurablePlugin struct {
+	Plugin
+}
+
+func (configurablePlugin) Options() []Option {
+	return []Option{
+		{Name: "style", Type: OptionString, Default: "plain"},
+		{Name: "strict", Type: OptionBool},
+		{Name: "depth", Type: OptionInt, Default: "3"},
+		{Name: "timeout", Type: OptionDuration},
+	}
+}
+
+func (configurablePlugin) Configure(Options) error { return nil }
+
+type invalidDefaultPlugin struct {
+	configurablePlugin
+}
+
+func (invalidDefaultPlugin) Options() []Option {
+	return []Option{
+		{Name: "depth", Type: OptionInt, Default: "three"},
+		{Name: "timeout", Type: OptionDuration, Default: "1s"},
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	pl := &pluginStruct{name: "mock", plugin: configurablePlugin{}}
+
+	t.Run("defaults", func(t *testing.T) {
+		opts, errs := parseOptions(pl, nil)
+		require.Empty(t, errs)
+		require.Equal(t, "plain", opts.String("style"))
+		require.False(t, opts.Bool("strict"))
+		require.Equal(t, 3, opts.Int("depth"))
+		require.False(t, opts.IsSet("depth"))
+		require.Panics(t, func() { opts.Int("style") })
+		require.Panics(t, func() { opts.String("unknown") })
+	})
+	t.Run("values", func(t *testing.T) {
+		opts, errs := parseOptions(pl, map[string]string{"style": "testify", "strict": "true", "timeout": "2s"})
+		require.Empty(t, errs)
+		require.Equal(t, "testify", opts.String("style"))
+		require.True(t, opts.Bool("strict"))
+		require.Equal(t, 2*time.Second, opts.Duration("timeout"))
+		require.True(t, opts.IsSet("style"))
+	})
+	t.Run("errors", func(t *testing.T) {
+		_, errs := parseOptions(pl, map[string]string{"depth": "x", "color": "red"})
+		require.Len(t, errs, 2)
+		require.EqualError(t, errs[0], `plugin mock: unknown option "color" (available: depth, strict, style, timeout)`)
+		require.EqualError(t, errs[1], `plugin mock: invalid int value "x" for option depth`)
+	})
+	t.Run("not configurable", func(t *testing.T) {
+		_, errs := parseOptions(&pluginStruct{name: "other"}, map[string]string{"a": "b"})
+		require.Len(t, errs, 1)
+		require.EqualError(t, errs[0], "plugin other does not accept options")
+	})
+	t.Run("invalid default", func(t *testing.T) {
+		_, errs := parseOptions(&pluginStruct{name: "other", plugin: invalidDefaultPlugin{}}, nil)
+		require.Len(t, errs, 1)
+		require.ErrorContains(t, errs[0], `plugin other: invalid default "three" of option depth`)
+	})
+}
+
+func TestParseOptionFlag(t *testing.T) {
+	plugin, key, value, err := ParseOptionFlag("mock.style=testify=1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"mock", "style", "testify=1"}, []string{plugin, key, value})
+
+	for _, s := range []string{"mock.style", "style=testify", ".style=x", "mock.=x"} {
+		_, _, _, err = ParseOptionFlag(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,131 @@
+package ggen
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// findOrphans looks for files with the ggen header that are not produced by this run: their plugin is no longer
+// registered, or their plugin is enabled but did not generate them (for example after changing GenerateFileName, or
+// when a plugin stops writing a file through GenerateFile). Files of registered plugins that are disabled in this run
+// are left alone. Orphans are marked for deletion if Config.RemoveOrphans is set, otherwise they are reported.
+//
+// Without a manifest, only the package directories and the directories written in this run are scanned. A file that a
+// plugin wrote through GenerateFile outside of the packages is missed once nothing is written to its directory, so a
+// warning suggests Config.ManifestFile when such files are generated.
+func (ng *engine) findOrphans() error {
+	if ng.onlyPackages != nil {
+		// partial run from Watch, the previous run already handled orphans
+		return nil
+	}
+	if ng.manifest != nil {
+		// files generated by enabled plugins in the previous run are already cleaned
+		return ng.findManifestOrphans()
+	}
+	dirs := make(map[string]bool)
+	for _, pkg := range ng.availablePkgs {
+		dirs[getPackageDir(pkg)] = true
+	}
+	outsideDirs := make(map[string]bool)
+	for _, filePath := range ng.generatedFiles {
+		dir := filepath.Dir(filePath)
+		if !dirs[dir] {
+			outsideDirs[dir] = true
+		}
+	}
+	if len(outsideDirs) != 0 && ng.xcfg.ManifestFile == "" {
+		ng.warn("files generated outside of the packages are not detected as orphans when they are no longer generated "+
+			"(set ManifestFile to track them)", "dirs", strings.Join(sortedKeys(outsideDirs), ", "))
+	}
+	for dir := range outsideDirs {
+		dirs[dir] = true
+	}
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+
+	for _, dir := range sortedDirs {
+		names, err := readDirNames(dir)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".go") {
+				continue
+			}
+			filePath := filepath.Join(dir, name)
+			if _, ok := ng.stagedFiles[filePath]; ok {
+				continue
+			}
+			if _, ok := ng.previousFiles[filePath]; ok {
+				continue // already cleaned
+			}
+			if ng.cache.isFreshFile(filePath) {
+				continue
+			}
+			plugin, ok, err := readGeneratedHeader(filePath)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if pl := ng.pluginsMap[plugin]; pl != nil && !pl.enabled {
+				continue
+			}
+			if err = ng.handleOrphan(filePath, plugin); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ng *engine) handleOrphan(filePath, plugin string) error {
+	reason := "plugin is not registered"
+	if ng.pluginsMap[plugin] != nil {
+		reason = "file is no longer generated by the plugin"
+	}
+	if !ng.xcfg.RemoveOrphans {
+		ng.warn("orphaned generated file (enable RemoveOrphans to delete it)", "file", filePath, "plugin", plugin, "reason", reason)
+
+		// in check mode, the orphan is reported as a pending deletion so the check fails
+		if !ng.xcfg.Check {
+			return nil
+		}
+	} else {
+		ng.logger.Debug("remove orphaned generated file", "file", filePath, "plugin", plugin, "reason", reason)
+	}
+	return ng.rememberPreviousFile(filePath)
+}
+
+// readGeneratedHeader reads the file until the package clause and returns the plugin from the ggen header.
+func readGeneratedHeader(filePath string) (plugin string, ok bool, _ error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", false, Errorf(err, "can not read file %v: %v", filePath, err)
+	}
+	defer func() { must(file.Close()) }()
+
+	var head []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		head = append(append(head, line...), '\n')
+		if strings.HasPrefix(string(line), "package ") {
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", false, Errorf(err, "can not read file %v: %v", filePath, err)
+	}
+	plugin, ok = parseGeneratedHeader(head)
+	return plugin, ok, nil
+}
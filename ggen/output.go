@@ -0,0 +1,165 @@
+package ggen
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var reGeneratedHeader = regexp.MustCompile(`^// Code generated by ggen (\S+)\. DO NOT EDIT\.$`)
+
+// parseGeneratedHeader looks for the "// Code generated by ggen <plugin>. DO NOT EDIT." line that printers write before
+// the package clause, and returns the plugin name.
+func parseGeneratedHeader(body []byte) (plugin string, ok bool) {
+	for len(body) > 0 {
+		var line []byte
+		line, body, _ = bytes.Cut(body, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if m := reGeneratedHeader.FindSubmatch(line); m != nil {
+			return string(m[1]), true
+		}
+		if bytes.HasPrefix(line, []byte("package ")) {
+			break
+		}
+	}
+	return "", false
+}
+
+// checkGeneratedFile refuses to delete or overwrite an existing file that was not generated by ggen.
+func (ng *engine) checkGeneratedFile(filePath string, action string) error {
+	body, exists := ng.previousFiles[filePath]
+	if !exists {
+		return nil
+	}
+	if _, ok := parseGeneratedHeader(body); !ok {
+		return Errorf(nil, "refusing to %v %v: the file was not generated by ggen (missing \"// Code generated by ggen <plugin>. DO NOT EDIT.\" header)", action, filePath)
+	}
+	return nil
+}
+
+// committedChange records a change applied to disk, for rolling it back.
+type committedChange struct {
+	FileChange
+
+	createdDirs []string
+}
+
+// commit writes the staged files and deletes the stale ones. When Config.Output is set, the files are written there
+// instead. Otherwise, each file is written to a temporary file in the same
+// directory, then renamed over the target. If any operation fails, the changes already applied are rolled back, so the
+// previous files are restored.
+func (ng *engine) commit(changes []FileChange) (_err error) {
+	if ng.xcfg.Output != nil {
+		return ng.commitOutput(changes)
+	}
+	done := make([]committedChange, 0, len(changes))
+	defer func() {
+		if _err == nil {
+			return
+		}
+		if err := ng.rollback(done); err != nil {
+			_err = Errorf(_err, "%v (rollback failed: %v)", _err, err)
+		}
+	}()
+	for _, change := range changes {
+		applied := committedChange{FileChange: change}
+		switch change.Action {
+		case FileCreated, FileUpdated:
+			dirs, err := mkdirAll(filepath.Dir(change.Path))
+			applied.createdDirs = dirs
+			if err != nil {
+				done = append(done, applied)
+				return err
+			}
+			if err = writeFileAtomic(change.Path, change.Body); err != nil {
+				done = append(done, applied)
+				return err
+			}
+		case FileDeleted:
+			if err := os.Remove(change.Path); err != nil && !os.IsNotExist(err) {
+				return Errorf(err, "can not remove file %v: %v", change.Path, err)
+			}
+		}
+		done = append(done, applied)
+	}
+	return nil
+}
+
+// rollback reverts the applied changes in reverse order.
+func (ng *engine) rollback(done []committedChange) error {
+	var errs []error
+	for i := len(done) - 1; i >= 0; i-- {
+		change := done[i]
+		switch change.Action {
+		case FileCreated:
+			if err := os.Remove(change.Path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		case FileUpdated, FileDeleted:
+			if err := writeFileAtomic(change.Path, ng.previousFiles[change.Path]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for j := len(change.createdDirs) - 1; j >= 0; j-- {
+			if err := os.Remove(change.createdDirs[j]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		ng.logger.Debug("rolled back", "file", change.Path, "action", change.Action)
+	}
+	return Errors("can not restore files", errs)
+}
+
+// mkdirAll is like os.MkdirAll, but returns the directories it created, from the outermost.
+func mkdirAll(dir string) (created []string, _ error) {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if parent := filepath.Dir(d); parent == d {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil && !os.IsExist(err) {
+			return created, Errorf(err, "create directory %q: %v", missing[i], err)
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
+
+// writeFileAtomic writes to a temporary file then renames it to the target, so the target is never half-written. The
+// permission of an existing file is kept.
+func writeFileAtomic(filePath string, body []byte) (_err error) {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(filePath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return Errorf(err, "can not write file %v: %v", filePath, err)
+	}
+	defer func() {
+		if _err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	_, err = tmp.Write(body)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		return Errorf(err, "can not write file %v: %v", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package ggen
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iolivernguyen/ggen/ggen/logging"
+)
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	updated := filepath.Join(dir, "updated.go")
+	deleted := filepath.Join(dir, "deleted.go")
+	created := filepath.Join(dir, "new", "created.go")
+	require.NoError(t, os.WriteFile(updated, []byte("old"), 0644))
+	require.NoError(t, os.WriteFile(deleted, []byte("deleted"), 0644))
+
+	newEngineWithFiles := func() *engine {
+		ng := newEngine(logging.NewLogger(defaultLogHandler{w: io.Discard}))
+		require.NoError(t, ng.rememberPreviousFile(updated))
+		require.NoError(t, ng.rememberPreviousFile(deleted))
+		return ng
+	}
+	changes := []FileChange{
+		{Path: created, Action: FileCreated, Body: []byte("created")},
+		{Path: deleted, Action: FileDeleted},
+		{Path: updated, Action: FileUpdated, Body: []byte("new")},
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		// the parent of the last file is a regular file, so it can not be written
+		invalid := filepath.Join(updated, "invalid.go")
+		failingChanges := append(changes[:len(changes):len(changes)], FileChange{Path: invalid, Action: FileCreated})
+
+		err := newEngineWithFiles().commit(failingChanges)
+		require.Error(t, err)
+		requireFile(t, updated, "old")
+		requireFile(t, deleted, "deleted")
+		require.NoFileExists(t, created)
+		require.NoDirExists(t, filepath.Dir(created))
+	})
+	t.Run("commit", func(t *testing.T) {
+		err := newEngineWithFiles().commit(changes)
+		require.NoError(t, err)
+		requireFile(t, updated, "new")
+		requireFile(t, created, "created")
+		require.NoFileExists(t, deleted)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2, "no temporary files are left")
+	})
+}
+
+func requireFile(t *testing.T, filePath string, expected string) {
+	body, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(body))
+}
+
+func TestParseGeneratedHeader(t *testing.T) {
+	t.Run("generated", func(t *testing.T) {
+		body := "//go:build !ggen\n// Code generated by ggen sample. DO NOT EDIT.\n\npackage one\n"
+		plugin, ok := parseGeneratedHeader([]byte(body))
+		require.True(t, ok)
+		require.Equal(t, "sample", plugin)
+	})
+	t.Run("other generator", func(t *testing.T) {
+		body := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage one\n"
+		_, ok := parseGeneratedHeader([]byte(body))
+		require.False(t, ok)
+	})
+	t.Run("after package clause", func(t *testing.T) {
+		body := "package one\n\n// Code generated by ggen sample. DO NOT EDIT.\n"
+		_, ok := parseGeneratedHeader([]byte(body))
+		require.False(t, ok)
+	})
+}
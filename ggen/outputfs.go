@@ -0,0 +1,233 @@
+package ggen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputFS is a writable file system receiving the generated files, see Config.Output. The paths are absolute, as
+// computed from the directories of the loaded packages.
+type OutputFS interface {
+	// WriteFile creates or replaces the file with the given content.
+	WriteFile(filePath string, body []byte) error
+
+	// Remove deletes a previously generated file. It is not an error if the file does not exist.
+	Remove(filePath string) error
+}
+
+// commitOutput writes the whole set of generated files to Config.Output, including the unchanged ones, and removes the
+// deleted files.
+func (ng *engine) commitOutput(changes []FileChange) error {
+	output := ng.xcfg.Output
+	filePaths := make([]string, len(ng.generatedFiles))
+	copy(filePaths, ng.generatedFiles)
+	sort.Strings(filePaths)
+	for _, filePath := range filePaths {
+		if err := output.WriteFile(filePath, ng.stagedFiles[filePath]); err != nil {
+			return Errorf(err, "can not write file %v: %v", filePath, err)
+		}
+	}
+	for _, change := range changes {
+		if change.Action != FileDeleted {
+			continue
+		}
+		if err := output.Remove(change.Path); err != nil {
+			return Errorf(err, "can not remove file %v: %v", change.Path, err)
+		}
+	}
+	return nil
+}
+
+// writeOutput writes a file produced by ggen itself, such as the manifest, to Config.Output or to disk.
+func (ng *engine) writeOutput(filePath string, body []byte) error {
+	if ng.xcfg.Output != nil {
+		if err := ng.xcfg.Output.WriteFile(filePath, body); err != nil {
+			return Errorf(err, "can not write file %v: %v", filePath, err)
+		}
+		return nil
+	}
+	return writeFileAtomic(filePath, body)
+}
+
+// MemFS keeps the generated files in memory. It is safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+var _ OutputFS = &MemFS{}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string][]byte)}
+}
+
+func (fs *MemFS) WriteFile(filePath string, body []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[filePath] = body
+	return nil
+}
+
+func (fs *MemFS) Remove(filePath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, filePath)
+	return nil
+}
+
+// ReadFile returns the content of a file, or an error satisfying os.IsNotExist if the file was not written.
+func (fs *MemFS) ReadFile(filePath string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	body, ok := fs.files[filePath]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: filePath, Err: os.ErrNotExist}
+	}
+	return body, nil
+}
+
+// Files returns the paths of the written files, sorted.
+func (fs *MemFS) Files() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	filePaths := make([]string, 0, len(fs.files))
+	for filePath := range fs.files {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+	return filePaths
+}
+
+// DirFS writes the generated files to a separate output root. A file at base/path is written to root/path. Files
+// outside of base are rejected.
+type DirFS struct {
+	root string
+	base string
+}
+
+var _ OutputFS = &DirFS{}
+
+func NewDirFS(root, base string) *DirFS {
+	return &DirFS{root: root, base: base}
+}
+
+func (fs *DirFS) WriteFile(filePath string, body []byte) error {
+	target, err := fs.target(filePath)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, body, 0644)
+}
+
+func (fs *DirFS) Remove(filePath string) error {
+	target, err := fs.target(filePath)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *DirFS) target(filePath string) (string, error) {
+	rel, err := relOutputPath(fs.base, filePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.root, filepath.FromSlash(rel)), nil
+}
+
+// archiveModTime is the modification time of all archive entries, for reproducible archives.
+var archiveModTime = time.Unix(0, 0).UTC()
+
+// ZipFS writes the generated files to a zip archive, with paths relative to base. Removed files are simply not added.
+// Close must be called to finish the archive.
+type ZipFS struct {
+	w    *zip.Writer
+	base string
+}
+
+var _ OutputFS = &ZipFS{}
+
+func NewZipFS(w io.Writer, base string) *ZipFS {
+	return &ZipFS{w: zip.NewWriter(w), base: base}
+}
+
+func (fs *ZipFS) WriteFile(filePath string, body []byte) error {
+	name, err := relOutputPath(fs.base, filePath)
+	if err != nil {
+		return err
+	}
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: archiveModTime}
+	header.SetMode(0644)
+	w, err := fs.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func (fs *ZipFS) Remove(filePath string) error { return nil }
+
+func (fs *ZipFS) Close() error { return fs.w.Close() }
+
+// TarFS writes the generated files to a tar archive, with paths relative to base. Removed files are simply not added.
+// Close must be called to finish the archive.
+type TarFS struct {
+	w    *tar.Writer
+	base string
+}
+
+var _ OutputFS = &TarFS{}
+
+func NewTarFS(w io.Writer, base string) *TarFS {
+	return &TarFS{w: tar.NewWriter(w), base: base}
+}
+
+func (fs *TarFS) WriteFile(filePath string, body []byte) error {
+	name, err := relOutputPath(fs.base, filePath)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(body)),
+		ModTime:  archiveModTime,
+	}
+	if err = fs.w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = fs.w.Write(body)
+	return err
+}
+
+func (fs *TarFS) Remove(filePath string) error { return nil }
+
+func (fs *TarFS) Close() error { return fs.w.Close() }
+
+// relOutputPath returns the slash-separated path of the file relative to base.
+func relOutputPath(base, filePath string) (string, error) {
+	rel, err := filepath.Rel(base, filePath)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", Errorf(nil, "file %v is outside of the output base %v", filePath, base)
+	}
+	return rel, nil
+}
@@ -0,0 +1,79 @@
+package ggen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirFS(t *testing.T) {
+	base := t.TempDir()
+	root := t.TempDir()
+	fs := NewDirFS(root, base)
+
+	require.NoError(t, fs.WriteFile(filepath.Join(base, "a", "zz_generated.go"), []byte("package a\n")))
+	requireFile(t, filepath.Join(root, "a", "zz_generated.go"), "package a\n")
+	require.NoError(t, fs.Remove(filepath.Join(base, "a", "zz_generated.go")))
+	require.NoFileExists(t, filepath.Join(root, "a", "zz_generated.go"))
+	require.NoError(t, fs.Remove(filepath.Join(base, "a", "missing.go")))
+
+	err := fs.WriteFile(filepath.Join(filepath.Dir(base), "outside.go"), nil)
+	require.ErrorContains(t, err, "outside of the output base")
+}
+
+func TestArchiveFS(t *testing.T) {
+	base := t.TempDir()
+	files := map[string]string{
+		"zz_generated.go":   "package main\n",
+		"a/zz_generated.go": "package a\n",
+	}
+	writeFiles := func(fs OutputFS) {
+		for _, name := range []string{"zz_generated.go", "a/zz_generated.go"} {
+			require.NoError(t, fs.WriteFile(filepath.Join(base, name), []byte(files[name])))
+		}
+	}
+
+	t.Run("zip", func(t *testing.T) {
+		var b bytes.Buffer
+		fs := NewZipFS(&b, base)
+		writeFiles(fs)
+		require.NoError(t, fs.Close())
+
+		r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		require.NoError(t, err)
+		actual := map[string]string{}
+		for _, file := range r.File {
+			rc, err := file.Open()
+			require.NoError(t, err)
+			body, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			actual[file.Name] = string(body)
+		}
+		require.Equal(t, files, actual)
+	})
+	t.Run("tar", func(t *testing.T) {
+		var b bytes.Buffer
+		fs := NewTarFS(&b, base)
+		writeFiles(fs)
+		require.NoError(t, fs.Close())
+
+		r := tar.NewReader(&b)
+		actual := map[string]string{}
+		for {
+			header, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			body, err := io.ReadAll(r)
+			require.NoError(t, err)
+			actual[header.Name] = string(body)
+		}
+		require.Equal(t, files, actual)
+	})
+}
@@ -1,7 +1,9 @@
 package ggen
 
 import (
+	"context"
 	"go/types"
+	"strings"
 )
 
 type Filterer interface {
@@ -12,6 +14,55 @@ type Qualifier interface {
 	Qualify(*types.Package) string
 }
 
+// Versioner is an optional interface for plugins that support incremental generation (see Config.CacheFile). By
+// implementing it, the plugin declares that its output for a package only depends on the package and its dependencies.
+// The version must be changed whenever the plugin generates different code for the same input.
+type Versioner interface {
+	Version() string
+}
+
+// Initializer is an optional interface for plugins that prepare their state before filtering. Init is called once per
+// run, after Configure.
+type Initializer interface {
+	Init(ctx context.Context, ng InitEngine) error
+}
+
+// InitEngine is passed to Initializer.Init. Packages are not loaded yet, so it only gives access to the logger and the
+// context of the run.
+type InitEngine interface {
+	Logger
+
+	Context() context.Context
+}
+
+type initEngine struct {
+	embededLogger
+
+	ctx context.Context
+}
+
+func (ng *initEngine) Context() context.Context { return ng.ctx }
+
+// PostProcessor is an optional interface for plugins that transform generated files, for example for adding license
+// headers or linting. PostProcess is called for every generated file of every plugin, after formatting and before the
+// file is written. The post-processors run in the order of enabled plugins. They must keep the ggen header.
+type PostProcessor interface {
+	PostProcess(filePath string, body []byte) ([]byte, error)
+}
+
+// Finalizer is an optional interface for plugins that act on the whole run, for example for writing an index of the
+// generated files. Finalize is called after all files are written (or would be written, in dry-run mode).
+type Finalizer interface {
+	Finalize(*Result) error
+}
+
+// Dependent is an optional interface for plugins that must run after other plugins, for example a mock generator which
+// uses the interfaces extracted by another plugin. The dependencies are enabled automatically. Plugins run in the order
+// of their dependencies, then in the order of enabling.
+type Dependent interface {
+	DependsOn() []string
+}
+
 type Plugin interface {
 
 	// Name returns name of the plugin. Each plugin must have a different name.
@@ -35,7 +86,59 @@ type pluginStruct struct {
 	index     int
 	plugin    Plugin
 	enabled   bool
+	version   string
+	dependsOn []string
+	stage     int
 	qualifier types.Qualifier
+	options   Options
+}
+
+func (ng *engine) initPlugins() error {
+	for _, pl := range ng.enabledPlugins {
+		initializer, ok := pl.plugin.(Initializer)
+		if !ok {
+			continue
+		}
+		initNg := &initEngine{embededLogger: embededLogger{ng.logger.With("plugin", pl.name)}, ctx: ng.ctx}
+		if err := initializer.Init(ng.ctx, initNg); err != nil {
+			return Errorf(err, "init plugin %v: %v", pl.name, err)
+		}
+	}
+	return nil
+}
+
+// postProcess runs the post-processors on a generated file. They must keep the ggen header, otherwise the file could
+// not be cleaned or overwritten by the next run.
+func (ng *engine) postProcess(filePath string, body []byte) ([]byte, error) {
+	_, hasHeader := parseGeneratedHeader(body)
+	for _, pl := range ng.enabledPlugins {
+		pp, ok := pl.plugin.(PostProcessor)
+		if !ok {
+			continue
+		}
+		var err error
+		body, err = pp.PostProcess(filePath, body)
+		if err != nil {
+			return nil, Errorf(err, "post-process %v by plugin %v: %v", filePath, pl.name, err)
+		}
+		if _, ok = parseGeneratedHeader(body); hasHeader && !ok {
+			return nil, Errorf(nil, "post-process %v by plugin %v: the \"// Code generated by ggen <plugin>. DO NOT EDIT.\" header is removed", filePath, pl.name)
+		}
+	}
+	return body, nil
+}
+
+func (ng *engine) finalizePlugins(result *Result) error {
+	for _, pl := range ng.enabledPlugins {
+		finalizer, ok := pl.plugin.(Finalizer)
+		if !ok {
+			continue
+		}
+		if err := finalizer.Finalize(result); err != nil {
+			return Errorf(err, "finalize plugin %v: %v", pl.name, err)
+		}
+	}
+	return nil
 }
 
 func (ng *engine) registerPlugin(plugin Plugin) error {
@@ -54,8 +157,109 @@ func (ng *engine) registerPlugin(plugin Plugin) error {
 	if q, ok := plugin.(Qualifier); ok {
 		pl.qualifier = q.Qualify
 	}
+	if v, ok := plugin.(Versioner); ok {
+		pl.version = v.Version()
+	}
+	if d, ok := plugin.(Dependent); ok {
+		pl.dependsOn = d.DependsOn()
+	}
 
 	ng.plugins = append(ng.plugins, pl)
 	ng.pluginsMap[name] = pl
 	return nil
 }
+
+// sortPlugins adds the dependencies of the given plugins, then sorts them so each plugin comes after its dependencies.
+// Otherwise, the given order is kept.
+func (ng *engine) sortPlugins(plugins []*pluginStruct) ([]*pluginStruct, error) {
+	var all []*pluginStruct
+	added := make(map[string]bool)
+	var add func(pl *pluginStruct) error
+	add = func(pl *pluginStruct) error {
+		if added[pl.name] {
+			return nil
+		}
+		added[pl.name] = true
+		all = append(all, pl)
+		for _, dep := range pl.dependsOn {
+			depPl := ng.pluginsMap[dep]
+			if depPl == nil {
+				return Errorf(nil, "plugin %v depends on %v, which is not registered", pl.name, dep)
+			}
+			if !added[dep] {
+				ng.logger.Debug("enable dependency", "plugin", dep, "required-by", pl.name)
+			}
+			if err := add(depPl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, pl := range plugins {
+		if err := add(pl); err != nil {
+			return nil, err
+		}
+	}
+
+	// repeatedly take the first plugin whose dependencies are all sorted
+	sorted := make([]*pluginStruct, 0, len(all))
+	done := make(map[string]bool)
+	for len(sorted) < len(all) {
+		progress := false
+		for _, pl := range all {
+			if done[pl.name] || !allDone(pl.dependsOn, done) {
+				continue
+			}
+			done[pl.name] = true
+			sorted = append(sorted, pl)
+			progress = true
+			break
+		}
+		if !progress {
+			return nil, Errorf(nil, "plugin dependency cycle: %v", strings.Join(ng.findCycle(all, done), " -> "))
+		}
+	}
+	return sorted, nil
+}
+
+func allDone(names []string, done map[string]bool) bool {
+	for _, name := range names {
+		if !done[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// findCycle returns a dependency cycle among the plugins which are not done, starting and ending with the same plugin.
+func (ng *engine) findCycle(plugins []*pluginStruct, done map[string]bool) []string {
+	var path []string
+	onPath := make(map[string]int)
+	visited := make(map[string]bool)
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		if i, ok := onPath[name]; ok {
+			return append(path[i:len(path):len(path)], name)
+		}
+		if visited[name] || done[name] {
+			return nil
+		}
+		visited[name] = true
+		onPath[name] = len(path)
+		path = append(path, name)
+		for _, dep := range ng.pluginsMap[name].dependsOn {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		delete(onPath, name)
+		return nil
+	}
+	for _, pl := range plugins {
+		if cycle := visit(pl.name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ggen
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iolivernguyen/ggen/ggen/logging"
+)
+
+type dependentPlugin struct {
+	name      string
+	dependsOn []string
+}
+
+func (p dependentPlugin) Name() string              { return p.name }
+func (p dependentPlugin) Filter(FilterEngine) error { return nil }
+func (p dependentPlugin) Generate(Engine) error     { return nil }
+func (p dependentPlugin) DependsOn() []string       { return p.dependsOn }
+
+func TestSortPlugins(t *testing.T) {
+	newEngineWithPlugins := func(plugins ...dependentPlugin) *engine {
+		ng := newEngine(logging.NewLogger(defaultLogHandler{w: io.Discard}))
+		for _, pl := range plugins {
+			require.NoError(t, ng.registerPlugin(pl))
+		}
+		return ng
+	}
+	sortNames := func(ng *engine, names ...string) ([]string, error) {
+		var plugins []*pluginStruct
+		for _, name := range names {
+			plugins = append(plugins, ng.pluginsMap[name])
+		}
+		sorted, err := ng.sortPlugins(plugins)
+		var result []string
+		for _, pl := range sorted {
+			result = append(result, pl.name)
+		}
+		return result, err
+	}
+
+	t.Run("dependencies first", func(t *testing.T) {
+		ng := newEngineWithPlugins(
+			dependentPlugin{name: "mock", dependsOn: []string{"iface"}},
+			dependentPlugin{name: "iface"},
+			dependentPlugin{name: "other"},
+		)
+		names, err := sortNames(ng, "mock", "other", "iface")
+		require.NoError(t, err)
+		require.Equal(t, []string{"iface", "mock", "other"}, names)
+	})
+	t.Run("enable dependencies", func(t *testing.T) {
+		ng := newEngineWithPlugins(
+			dependentPlugin{name: "a", dependsOn: []string{"b", "c"}},
+			dependentPlugin{name: "b", dependsOn: []string{"c"}},
+			dependentPlugin{name: "c"},
+			dependentPlugin{name: "d"},
+		)
+		names, err := sortNames(ng, "d", "a")
+		require.NoError(t, err)
+		require.Equal(t, []string{"d", "c", "b", "a"}, names)
+	})
+	t.Run("not registered", func(t *testing.T) {
+		ng := newEngineWithPlugins(dependentPlugin{name: "a", dependsOn: []string{"x"}})
+		_, err := sortNames(ng, "a")
+		require.EqualError(t, err, "plugin a depends on x, which is not registered")
+	})
+	t.Run("cycle", func(t *testing.T) {
+		ng := newEngineWithPlugins(
+			dependentPlugin{name: "a", dependsOn: []string{"b"}},
+			dependentPlugin{name: "b", dependsOn: []string{"c"}},
+			dependentPlugin{name: "c", dependsOn: []string{"b"}},
+		)
+		_, err := sortNames(ng, "a")
+		require.EqualError(t, err, "plugin dependency cycle: b -> c -> b")
+	})
+}
@@ -79,7 +79,7 @@ func (p *printer) Bytes() []byte {
 	return p.buf.Bytes()
 }
 
-func (p *printer) Close() (_err error) {
+func (p *printer) Close() error {
 	if p.closed {
 		return nil
 	}
@@ -89,17 +89,23 @@ func (p *printer) Close() (_err error) {
 		p.engine.bufPool.Put(p.buf)
 	}()
 
-	w, err := p.engine.writeFile(p.filePath)
-	if err != nil {
+	var b bytes.Buffer
+	if err := p.writeTo(&b); err != nil {
 		return err
 	}
-	defer func() {
-		err2 := w.Close()
-		if _err == nil {
-			_err = err2
-		}
-	}()
+	body, err := p.engine.formatSource(p.filePath, b.Bytes())
+	if err != nil {
+		return Errorf(err, "%v: goimports %v: %v", p.plugin.name, p.filePath, err)
+	}
+	p.engine.recordOutput(p.plugin, p.PkgPath(), p.filePath)
+	return p.engine.stageFile(p.filePath, body)
+}
+
+// ggenBuildConstraint excludes the generated files when loading packages with the ggen tag, so plugins do not see
+// outdated generated code.
+const ggenBuildConstraint = "//go:build !ggen\n"
 
+func (p *printer) writeTo(w io.Writer) (_err error) {
 	fprintf := func(format string, args ...any) {
 		if _err != nil {
 			return
@@ -110,7 +116,7 @@ func (p *printer) Close() (_err error) {
 			return
 		}
 	}
-	fprintf("//go:build !ggen\n")
+	fprintf(ggenBuildConstraint)
 	fprintf("// Code generated by ggen %v. DO NOT EDIT.\n\n", p.plugin.name)
 	fprintf("package %v\n\n", p.pkgName)
 	fprintf("import (\n")
@@ -0,0 +1,290 @@
+package ggen
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+type FileAction int
+
+const (
+	FileCreated FileAction = iota + 1
+	FileUpdated
+	FileDeleted
+)
+
+func (a FileAction) String() string {
+	switch a {
+	case FileCreated:
+		return "create"
+	case FileUpdated:
+		return "update"
+	case FileDeleted:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// FileChange describes a generated file that is (or would be, in dry-run mode) created, updated or deleted.
+type FileChange struct {
+	Path   string
+	Action FileAction
+
+	// Body is the formatted content of the file. It is nil for deleted files.
+	Body []byte
+
+	// Diff is the unified diff from the current content on disk to Body. It is only populated in check mode.
+	Diff string
+}
+
+// Result is returned by Start after a successful run.
+type Result struct {
+	// Files lists the files that are created, updated or deleted, sorted by path. In dry-run mode, they are the files
+	// that would be changed. Files with unchanged content are not listed.
+	Files []FileChange
+
+	// Generated lists all files generated in this run, including the unchanged ones, sorted by path.
+	Generated []string
+
+	// Unchanged lists the generated files whose content is the same as on disk, and the outputs of packages skipped
+	// by the cache, sorted by path.
+	Unchanged []string
+
+	// Deleted lists the files that are (or would be, in dry-run mode) deleted, sorted by path.
+	Deleted []string
+
+	// Plugins reports the work of each enabled plugin, in the order of running.
+	Plugins []PluginResult
+
+	Timings Timings
+
+	// Warnings are the problems that do not fail the run, such as orphaned generated files. They are also logged.
+	Warnings []string
+}
+
+// PluginResult reports the work of a plugin in a run.
+type PluginResult struct {
+	Name string
+
+	// Packages is the number of packages generated by the plugin.
+	Packages int
+
+	// Cached is the number of packages skipped because their inputs are unchanged.
+	Cached int
+
+	// Files is the number of files generated by the plugin.
+	Files int
+
+	// Duration is the time spent in Filter and Generate of the plugin.
+	Duration time.Duration
+}
+
+// Timings reports the time spent in each phase of a run.
+type Timings struct {
+	// Load is the time for loading and type-checking packages.
+	Load time.Duration
+
+	// Filter is the time for parsing directives and running Filter of all plugins.
+	Filter time.Duration
+
+	// Generate is the time for running Generate of all plugins, including formatting the generated files.
+	Generate time.Duration
+
+	// Write is the time for writing the generated files, the cache and the manifest.
+	Write time.Duration
+
+	Total time.Duration
+}
+
+// rememberPreviousFile keeps the current content of a file before it is removed or overwritten, for reporting changes
+// later.
+func (ng *engine) rememberPreviousFile(filePath string) error {
+	if _, ok := ng.previousFiles[filePath]; ok {
+		return nil
+	}
+	body, err := os.ReadFile(filePath)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return Errorf(err, "can not read file %v: %v", filePath, err)
+	}
+	ng.previousFiles[filePath] = body
+	return nil
+}
+
+// stageFile records the content of a generated file, after post-processing. Nothing is written to disk until all
+// plugins succeed, see commit.
+func (ng *engine) stageFile(filePath string, body []byte) error {
+	body, err := ng.postProcess(filePath, body)
+	if err != nil {
+		return err
+	}
+	if err := ng.rememberPreviousFile(filePath); err != nil {
+		return err
+	}
+	if err := ng.checkGeneratedFile(filePath, "overwrite"); err != nil {
+		return err
+	}
+	if _, ok := ng.stagedFiles[filePath]; !ok {
+		ng.generatedFiles = append(ng.generatedFiles, filePath)
+	}
+	ng.stagedFiles[filePath] = body
+	return nil
+}
+
+// collectChanges compares the generated files with their previous content.
+func (ng *engine) collectChanges() ([]FileChange, error) {
+	var changes []FileChange
+	generated := make(map[string]bool, len(ng.generatedFiles))
+	for _, filePath := range ng.generatedFiles {
+		generated[filePath] = true
+		body := ng.stagedFiles[filePath]
+		prev, existed := ng.previousFiles[filePath]
+		switch {
+		case !existed:
+			changes = append(changes, FileChange{Path: filePath, Action: FileCreated, Body: body})
+		case !bytes.Equal(prev, body):
+			changes = append(changes, FileChange{Path: filePath, Action: FileUpdated, Body: body})
+		}
+	}
+	for filePath := range ng.previousFiles {
+		if !generated[filePath] {
+			changes = append(changes, FileChange{Path: filePath, Action: FileDeleted})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	if ng.xcfg.Check {
+		for i := range changes {
+			diff, err := ng.diffFile(changes[i])
+			if err != nil {
+				return nil, err
+			}
+			changes[i].Diff = diff
+		}
+	}
+	return changes, nil
+}
+
+// buildResult summarizes the run.
+func (ng *engine) buildResult(changes []FileChange) *Result {
+	result := &Result{
+		Files:     changes,
+		Generated: slices.Clone(ng.generatedFiles),
+		Warnings:  ng.warnings,
+	}
+	sort.Strings(result.Generated)
+	for _, filePath := range result.Generated {
+		prev, existed := ng.previousFiles[filePath]
+		if existed && bytes.Equal(prev, ng.stagedFiles[filePath]) {
+			result.Unchanged = append(result.Unchanged, filePath)
+		}
+	}
+	if ng.cache != nil {
+		for filePath := range ng.cache.freshFiles {
+			if _, ok := ng.previousFiles[filePath]; !ok {
+				result.Unchanged = append(result.Unchanged, filePath)
+			}
+		}
+	}
+	sort.Strings(result.Unchanged)
+	for _, change := range changes {
+		if change.Action == FileDeleted {
+			result.Deleted = append(result.Deleted, change.Path)
+		}
+	}
+
+	files := make(map[string]int)
+	for _, owner := range ng.outputOwners {
+		files[owner.plugin.name]++
+	}
+	for _, pl := range ng.enabledPlugins {
+		plResult := PluginResult{
+			Name:     pl.name,
+			Cached:   ng.cache.skippedCount(pl),
+			Files:    files[pl.name],
+			Duration: ng.pluginDurations[pl.name],
+		}
+		for _, p := range ng.sortedIncludedPackages {
+			if p.Included[pl.index] {
+				plResult.Packages++
+			}
+		}
+		result.Plugins = append(result.Plugins, plResult)
+	}
+	result.Timings = ng.timings
+	result.Timings.Total = time.Since(ng.startTime)
+	return result
+}
+
+// warn logs a warning and reports it in the Result.
+func (ng *engine) warn(warning string, args ...any) {
+	ng.logger.Warn(warning, args...)
+	ng.warnings = append(ng.warnings, formatWarning(warning, args))
+}
+
+func formatWarning(warning string, args []any) string {
+	var b strings.Builder
+	b.WriteString(warning)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	return b.String()
+}
+
+func (ng *engine) diffFile(change FileChange) (string, error) {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(ng.previousFiles[change.Path])),
+		B:        difflib.SplitLines(string(change.Body)),
+		FromFile: change.Path,
+		ToFile:   change.Path,
+		Context:  3,
+	}
+	switch change.Action {
+	case FileCreated:
+		diff.A, diff.FromFile = nil, "/dev/null"
+	case FileDeleted:
+		diff.B, diff.ToFile = nil, "/dev/null"
+	}
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return "", Errorf(err, "diff %v: %v", change.Path, err)
+	}
+	return text, nil
+}
+
+// StaleError is returned by Start in check mode when the generated files on disk are out of date, missing or
+// orphaned. The Result is still returned together with the error.
+type StaleError struct {
+	Files []FileChange
+}
+
+func (e *StaleError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v generated file(s) are out of date:", len(e.Files))
+	for _, file := range e.Files {
+		fmt.Fprintf(&b, "\n\t%v: %v", file.Path, staleReason(file.Action))
+	}
+	return b.String()
+}
+
+func staleReason(action FileAction) string {
+	switch action {
+	case FileCreated:
+		return "missing"
+	case FileDeleted:
+		return "orphaned"
+	default:
+		return "changed"
+	}
+}
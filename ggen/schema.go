@@ -0,0 +1,311 @@
+package ggen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// DirectiveDeclarer is an optional interface for plugins that own directive commands. When any plugin declares a
+// command, all directives in the same namespace (the part of the command before the first ":", like "gen" in
+// "gen:mock") must be declared by a registered plugin. Misspelled commands, directives attached to the wrong kind of
+// item and invalid arguments are rejected before filtering. Plugins that do not declare their commands can only use
+// the namespaces that no plugin declares.
+type DirectiveDeclarer interface {
+	Directives() []DirectiveSpec
+}
+
+// ItemKind is the kind of item that a directive is attached to.
+type ItemKind int
+
+const (
+	ItemPackage ItemKind = iota + 1
+	ItemType
+	ItemField
+	ItemFunc
+	ItemMethod
+	ItemConst
+	ItemVar
+)
+
+func (k ItemKind) String() string {
+	switch k {
+	case ItemPackage:
+		return "package"
+	case ItemType:
+		return "type"
+	case ItemField:
+		return "field"
+	case ItemFunc:
+		return "func"
+	case ItemMethod:
+		return "method"
+	case ItemConst:
+		return "const"
+	case ItemVar:
+		return "var"
+	default:
+		return "unknown"
+	}
+}
+
+// DirectiveSpec declares a directive command. The spec also covers the sub-commands, like "gen:mock:config" for
+// "gen:mock", except for Args.
+type DirectiveSpec struct {
+	Cmd string
+
+	// On lists the kinds of items the directive can be attached to. Package-level directives are followed by a blank
+	// line. Empty means any kind.
+	On []ItemKind
+
+	// Args is a struct value (or a pointer to it) with ggen tags. If set, the argument of the directive must be
+	// decodable into it (see Directive.Decode). It does not apply to the sub-commands.
+	Args any
+}
+
+func (s DirectiveSpec) allows(kind ItemKind) bool {
+	if len(s.On) == 0 {
+		return true
+	}
+	for _, k := range s.On {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+type directiveSchema struct {
+	specs      map[string]DirectiveSpec
+	namespaces map[string]bool
+}
+
+func directiveNamespace(cmd string) string {
+	ns, _, _ := strings.Cut(cmd, ":")
+	return ns
+}
+
+// directiveSchema collects the directive specs of all registered plugins. It returns nil if no plugin declares
+// directives.
+func (ng *engine) directiveSchema() (*directiveSchema, error) {
+	var schema *directiveSchema
+	owners := make(map[string]string)
+	for _, pl := range ng.plugins {
+		declarer, ok := pl.plugin.(DirectiveDeclarer)
+		if !ok {
+			continue
+		}
+		if schema == nil {
+			schema = &directiveSchema{specs: map[string]DirectiveSpec{}, namespaces: map[string]bool{}}
+		}
+		for _, spec := range declarer.Directives() {
+			if !reCommand.MatchString(spec.Cmd) {
+				return nil, Errorf(nil, "plugin %v: invalid directive command %q", pl.name, spec.Cmd)
+			}
+			if owner := owners[spec.Cmd]; owner != "" {
+				return nil, Errorf(nil, "directive %v is declared by both plugins %v and %v", spec.Cmd, owner, pl.name)
+			}
+			owners[spec.Cmd] = pl.name
+			schema.specs[spec.Cmd] = spec
+			schema.namespaces[directiveNamespace(spec.Cmd)] = true
+		}
+	}
+	return schema, nil
+}
+
+// lookup returns the spec of the command or its parent commands, and whether the spec is of the command itself. The
+// third result is false if the command is not in a declared namespace.
+func (s *directiveSchema) lookup(cmd string) (spec DirectiveSpec, exact, checked, found bool) {
+	if !s.namespaces[directiveNamespace(cmd)] {
+		return DirectiveSpec{}, false, false, false
+	}
+	for c := cmd; ; {
+		if spec, ok := s.specs[c]; ok {
+			return spec, c == cmd, true, true
+		}
+		idx := strings.LastIndexByte(c, ':')
+		if idx < 0 {
+			return DirectiveSpec{}, false, true, false
+		}
+		c = c[:idx]
+	}
+}
+
+func (s *directiveSchema) check(d Directive, kind ItemKind) error {
+	spec, exact, checked, found := s.lookup(d.Cmd)
+	switch {
+	case !checked:
+		return nil
+	case !found:
+		if suggestion := s.suggest(d.Cmd); suggestion != "" {
+			return d.Errorf("unknown directive +%v (did you mean +%v?)", d.Cmd, suggestion)
+		}
+		return d.Errorf("unknown directive +%v", d.Cmd)
+	case !spec.allows(kind):
+		allowed := make([]string, len(spec.On))
+		for i, k := range spec.On {
+			allowed[i] = k.String()
+		}
+		return d.Errorf("directive +%v can not be attached to a %v (allowed: %v)", d.Cmd, kind, strings.Join(allowed, ", "))
+	case spec.Args != nil && exact:
+		typ := reflect.TypeOf(spec.Args)
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		return d.Decode(reflect.New(typ).Interface())
+	}
+	return nil
+}
+
+// suggest returns the closest declared command, if it is close enough to be a typo.
+func (s *directiveSchema) suggest(cmd string) string {
+	best, bestDist := "", 3
+	cmds := make([]string, 0, len(s.specs))
+	for c := range s.specs {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	for _, c := range cmds {
+		if dist := editDistance(cmd, c); dist < bestDist {
+			best, bestDist = c, dist
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// validateDirectives checks the directives of the collected packages against the declared specs. Package-level
+// directives come from the collected packages, directives of items from the doc comments in the sources.
+func (ng *engine) validateDirectives(pkgs []*packages.Package, collectedPackages []filteringPackage, srcMap map[string][]byte) error {
+	schema, err := ng.directiveSchema()
+	if err != nil || schema == nil {
+		return err
+	}
+	pkgByPath := make(map[string]*packages.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		pkgByPath[pkg.PkgPath] = pkg
+	}
+
+	var errs []error
+	fset := token.NewFileSet()
+	for _, p := range collectedPackages {
+		for _, d := range p.Directives {
+			if err = schema.check(d, ItemPackage); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		pkg := pkgByPath[p.PkgPath]
+		if pkg == nil {
+			continue
+		}
+		for _, filePath := range pkg.CompiledGoFiles {
+			body, ok := srcMap[filePath]
+			if !ok {
+				continue // generated file
+			}
+			file, err := parser.ParseFile(fset, filePath, body, parser.ParseComments|parser.SkipObjectResolution)
+			if err != nil {
+				return Errorf(err, "can not parse file %v: %v", filePath, err)
+			}
+			visitDocs(file, func(kind ItemKind, doc *ast.CommentGroup) {
+				for _, line := range doc.List {
+					if !hasStartDirective(line.Text) {
+						continue
+					}
+					d, err := ParseDirective(line.Text)
+					if err != nil {
+						continue // already reported as ignored directive
+					}
+					d.Pos = line.Pos() + token.Pos(directiveOffset(line.Text))
+					d.Position = fset.Position(d.Pos)
+					if err = schema.check(d, kind); err != nil {
+						errs = append(errs, err)
+					}
+				}
+			})
+		}
+	}
+	return Errors("invalid directives", errs)
+}
+
+// visitDocs calls fn with the doc comment of each item in the file, like processDoc. The doc comment of a declaration
+// with a single spec belongs to the spec.
+func visitDocs(file *ast.File, fn func(ItemKind, *ast.CommentGroup)) {
+	visit := func(kind ItemKind, docs ...*ast.CommentGroup) {
+		for _, doc := range docs {
+			if doc != nil {
+				fn(kind, doc)
+				return
+			}
+		}
+	}
+	visitFields := func(kind ItemKind, fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			visit(kind, field.Doc)
+		}
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncDecl:
+			if node.Recv != nil {
+				visit(ItemMethod, node.Doc)
+			} else {
+				visit(ItemFunc, node.Doc)
+			}
+			return false // skip the body
+
+		case *ast.GenDecl:
+			var genDoc *ast.CommentGroup
+			if len(node.Specs) == 1 {
+				genDoc = node.Doc
+			}
+			for _, spec := range node.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					visit(ItemType, spec.Doc, genDoc)
+				case *ast.ValueSpec:
+					kind := ItemVar
+					if node.Tok == token.CONST {
+						kind = ItemConst
+					}
+					visit(kind, spec.Doc, genDoc)
+				}
+			}
+
+		case *ast.StructType:
+			visitFields(ItemField, node.Fields)
+
+		case *ast.InterfaceType:
+			visitFields(ItemMethod, node.Methods)
+		}
+		return true
+	})
+}
@@ -0,0 +1,28 @@
+package ggen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectiveSchemaCheck(t *testing.T) {
+	schema := &directiveSchema{
+		specs: map[string]DirectiveSpec{
+			"gen:mock": {Cmd: "gen:mock", On: []ItemKind{ItemType}, Args: decodeArgs{}},
+		},
+		namespaces: map[string]bool{"gen": true},
+	}
+	check := func(raw string, kind ItemKind) error {
+		d, err := ParseDirective(raw)
+		require.NoError(t, err)
+		return schema.check(d, kind)
+	}
+
+	require.NoError(t, check("+gen:mock name=foo", ItemType))
+	require.ErrorContains(t, check("+gen:mock count=1", ItemType), `missing required key "name"`)
+	require.NoError(t, check("+gen:mock:config path=foo.json", ItemType), "args only apply to the command itself")
+	require.ErrorContains(t, check("+gen:mock:config", ItemFunc), "can not be attached to a func")
+	require.ErrorContains(t, check("+gen:mok", ItemType), "unknown directive +gen:mok (did you mean +gen:mock?)")
+	require.NoError(t, check("+other:mok", ItemType), "the namespace is not declared")
+}
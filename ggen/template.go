@@ -0,0 +1,263 @@
+package ggen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"go/types"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// TemplateFileExt is the extension of template plugin files: plugin foo is defined by foo.ggen.tmpl.
+const TemplateFileExt = ".ggen.tmpl"
+
+var reTemplateCommand = regexp.MustCompile(`^\{\{/\*\s*command:\s*(\S+)\s*\*/\}\}\n?`)
+
+// TemplatePlugin is a plugin rendering a text/template for every package with objects marked by a directive command,
+// so generators can be written without Go code. Packages are included when they have the directive, at package level
+// or attached to a declaration. The template is executed once per package with TemplateData, and the output is written
+// after the import declarations of the generated file. Missing imports are added automatically.
+//
+// The template can use these functions, in addition to the built-in ones:
+//
+//	typeString TYPE_OR_OBJECT  the type as written in the generated file (Printer.TypeString)
+//	import [NAME] PATH         adds an import, useful for aliases (Printer.Import)
+//	comment OBJECT             the doc comment text, without directives (Engine.GetComment)
+//	directives OBJECT          the directives (Engine.GetDirectives)
+//	fields OBJECT              the fields of a struct type
+//	methods OBJECT             the declared methods of a named type
+//	lower, upper, quote        string helpers
+type TemplatePlugin struct {
+	name     string
+	command  string
+	text     string
+	template *template.Template
+}
+
+var _ Plugin = &TemplatePlugin{}
+var _ Versioner = &TemplatePlugin{}
+var _ DirectiveDeclarer = &TemplatePlugin{}
+
+// TemplateData is passed to the template of a TemplatePlugin.
+type TemplateData struct {
+	Package *GeneratingPackage
+
+	// Directives are the package-level directives of the command.
+	Directives Directives
+
+	// Objects are the package-level objects with the directive of the command, sorted by name.
+	Objects []TemplateObject
+}
+
+type TemplateObject struct {
+	types.Object
+
+	// Directive is the first directive of the command attached to the object.
+	Directive Directive
+}
+
+// NewTemplatePlugin creates a template plugin filtering on the given directive command. The command defaults to
+// gen:<name>.
+func NewTemplatePlugin(name, command, text string) (*TemplatePlugin, error) {
+	if command == "" {
+		command = "gen:" + name
+	}
+	if !reCommand.MatchString(command) {
+		return nil, Errorf(nil, "template plugin %v: invalid command %q", name, command)
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs(nil, nil)).Parse(text)
+	if err != nil {
+		return nil, Errorf(err, "template plugin %v: %v", name, err)
+	}
+	return &TemplatePlugin{name: name, command: command, text: text, template: tmpl}, nil
+}
+
+// LoadTemplatePlugin loads a template plugin from a file. The name of the plugin is the file name without the
+// .ggen.tmpl extension. The command can be declared in a comment at the beginning of the file, it defaults to
+// gen:<name>:
+//
+//	{{/* command: gen:stringer */}}
+func LoadTemplatePlugin(filePath string) (*TemplatePlugin, error) {
+	body, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, Errorf(err, "can not read template %v: %v", filePath, err)
+	}
+	name := filepath.Base(filePath)
+	if !strings.HasSuffix(name, TemplateFileExt) {
+		return nil, Errorf(nil, "template %v must have the extension %v", filePath, TemplateFileExt)
+	}
+	name = strings.TrimSuffix(name, TemplateFileExt)
+	text, command := string(body), ""
+	if m := reTemplateCommand.FindStringSubmatch(text); m != nil {
+		command = m[1]
+		text = text[len(m[0]):]
+	}
+	return NewTemplatePlugin(name, command, text)
+}
+
+// LoadTemplatePlugins loads the template plugins matching a glob pattern, or all .ggen.tmpl files if the pattern is a
+// directory.
+func LoadTemplatePlugins(pattern string) ([]*TemplatePlugin, error) {
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*"+TemplateFileExt)
+	}
+	filePaths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, Errorf(err, "invalid template pattern %v: %v", pattern, err)
+	}
+	var plugins []*TemplatePlugin
+	for _, filePath := range filePaths {
+		pl, err := LoadTemplatePlugin(filePath)
+		if err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, pl)
+	}
+	return plugins, nil
+}
+
+func (p *TemplatePlugin) Name() string { return p.name }
+
+// Command returns the directive command of the plugin.
+func (p *TemplatePlugin) Command() string { return p.command }
+
+// Version changes whenever the template changes, so the cache is invalidated.
+func (p *TemplatePlugin) Version() string {
+	sum := sha256.Sum256([]byte(p.command + "\n" + p.text))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (p *TemplatePlugin) Directives() []DirectiveSpec {
+	return []DirectiveSpec{{Cmd: p.command}}
+}
+
+func (p *TemplatePlugin) Filter(ng FilterEngine) error {
+	return FilterByCommand(p.command).FilterAll(ng)
+}
+
+func (p *TemplatePlugin) Generate(ng Engine) error {
+	filter := FilterByCommand(p.command)
+	for _, gpkg := range ng.GeneratingPackages() {
+		data := TemplateData{Package: gpkg}
+		for _, d := range gpkg.GetDirectives() {
+			if filter.Include(Directives{d}) {
+				data.Directives = append(data.Directives, d)
+			}
+		}
+		for _, obj := range gpkg.GetObjects() {
+			for _, d := range ng.GetDirectives(obj) {
+				if filter.Include(Directives{d}) {
+					data.Objects = append(data.Objects, TemplateObject{Object: obj, Directive: d})
+					break
+				}
+			}
+		}
+
+		prt := gpkg.GetPrinter()
+		tmpl, err := p.template.Clone()
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err = tmpl.Funcs(templateFuncs(ng, prt)).Execute(&b, data); err != nil {
+			return Errorf(err, "package %v: %v", gpkg.PkgPath, err)
+		}
+		if len(bytes.TrimSpace(b.Bytes())) == 0 {
+			continue
+		}
+		if _, err = prt.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func templateFuncs(ng Engine, prt Printer) template.FuncMap {
+	toObject := func(v any) (types.Object, error) {
+		switch v := v.(type) {
+		case TemplateObject:
+			return v.Object, nil
+		case types.Object:
+			return v, nil
+		default:
+			return nil, Errorf(nil, "expected an object, got %T", v)
+		}
+	}
+	return template.FuncMap{
+		"typeString": func(v any) (string, error) {
+			switch v := v.(type) {
+			case types.Type:
+				return prt.TypeString(v), nil
+			case TemplateObject:
+				return prt.TypeString(v.Type()), nil
+			case types.Object:
+				return prt.TypeString(v.Type()), nil
+			default:
+				return "", Errorf(nil, "typeString: expected a type or an object, got %T", v)
+			}
+		},
+		"import": func(args ...string) (string, error) {
+			switch len(args) {
+			case 1:
+				prt.Import("", args[0])
+			case 2:
+				prt.Import(args[0], args[1])
+			default:
+				return "", Errorf(nil, "import: expected [NAME] PATH")
+			}
+			return "", nil
+		},
+		"comment": func(v any) (string, error) {
+			obj, err := toObject(v)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(ng.GetComment(obj).Text()), nil
+		},
+		"directives": func(v any) (Directives, error) {
+			obj, err := toObject(v)
+			if err != nil {
+				return nil, err
+			}
+			return ng.GetDirectives(obj), nil
+		},
+		"fields": func(v any) ([]*types.Var, error) {
+			obj, err := toObject(v)
+			if err != nil {
+				return nil, err
+			}
+			st, ok := obj.Type().Underlying().(*types.Struct)
+			if !ok {
+				return nil, Errorf(nil, "fields: %v is not a struct", obj.Name())
+			}
+			fields := make([]*types.Var, st.NumFields())
+			for i := range fields {
+				fields[i] = st.Field(i)
+			}
+			return fields, nil
+		},
+		"methods": func(v any) ([]*types.Func, error) {
+			obj, err := toObject(v)
+			if err != nil {
+				return nil, err
+			}
+			named, ok := obj.Type().(*types.Named)
+			if !ok {
+				return nil, nil
+			}
+			methods := make([]*types.Func, named.NumMethods())
+			for i := range methods {
+				methods[i] = named.Method(i)
+			}
+			return methods, nil
+		},
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"quote": strconv.Quote,
+	}
+}
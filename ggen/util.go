@@ -3,6 +3,7 @@ package ggen
 import (
 	"fmt"
 	"go/ast"
+	"go/token"
 	"go/types"
 	"os"
 	"path/filepath"
@@ -104,7 +105,12 @@ func defaultFileNameGenerator(tpl string) func(GenerateFileNameInput) string {
 var ggenPath = reflect.TypeOf((*Engine)(nil)).Elem().PkgPath()
 var builtinPath = filepath.Dir(ggenPath) + "/builtin"
 
+// parseBuiltinTypes reads the builtin types from the builtin package. If the package can not be loaded, for example
+// when generating a module which does not depend on ggen, the types are read from the universe scope instead.
 func parseBuiltinTypes(pkg *packages.Package) map[string]types.Type {
+	if pkg == nil || len(pkg.Errors) != 0 || pkg.Types == nil {
+		return universeBuiltinTypes()
+	}
 	if pkg.PkgPath != builtinPath {
 		panic(fmt.Sprintf("unexpected path %v", pkg.PkgPath))
 	}
@@ -120,6 +126,16 @@ func parseBuiltinTypes(pkg *packages.Package) map[string]types.Type {
 	return m
 }
 
+func universeBuiltinTypes() map[string]types.Type {
+	m := map[string]types.Type{}
+	for _, name := range types.Universe.Names() {
+		if obj, ok := types.Universe.Lookup(name).(*types.TypeName); ok {
+			m[obj.Type().String()] = obj.Type()
+		}
+	}
+	return m
+}
+
 func getPackageDir(pkg *packages.Package) string {
 	if len(pkg.GoFiles) > 0 {
 		return filepath.Dir(pkg.GoFiles[0])
@@ -133,8 +149,14 @@ func hasStartDirective(line string) bool {
 		strings.HasPrefix(line, startDirectiveStr2)
 }
 
+// directiveOffset returns the byte offset of the directive in a comment line, after "//" and spaces.
+func directiveOffset(line string) int {
+	text := strings.TrimPrefix(line, "//")
+	return len(line) - len(strings.TrimLeft(text, " \t"))
+}
+
 // processDoc splits directive and text comment
-func processDoc(doc, cmt *ast.CommentGroup) (Comment, error) {
+func processDoc(fset *token.FileSet, doc, cmt *ast.CommentGroup) (Comment, error) {
 	if doc == nil {
 		return Comment{Comment: cmt}, nil
 	}
@@ -151,6 +173,10 @@ func processDoc(doc, cmt *ast.CommentGroup) (Comment, error) {
 		if err != nil {
 			return Comment{}, err
 		}
+		directive.Pos = line.Pos() + token.Pos(directiveOffset(line.Text))
+		if fset != nil {
+			directive.Position = fset.Position(directive.Pos)
+		}
 		directives = append(directives, directive)
 	}
 
@@ -162,6 +188,7 @@ func processDoc(doc, cmt *ast.CommentGroup) (Comment, error) {
 	return comment, nil
 }
 
+// processDocText returns the text of the doc comment without the directive lines.
 func processDocText(doc *ast.CommentGroup) string {
 	if doc == nil {
 		return ""
@@ -169,9 +196,9 @@ func processDocText(doc *ast.CommentGroup) string {
 	processedDoc := make([]*ast.Comment, 0, len(doc.List))
 	for _, line := range doc.List {
 		if hasStartDirective(line.Text) {
-			processedDoc = append(processedDoc, line)
 			continue
 		}
+		processedDoc = append(processedDoc, line)
 	}
 	return (&ast.CommentGroup{List: processedDoc}).Text()
 }
@@ -182,12 +209,15 @@ func ParseDirectiveFromFile(filename string) (directives, inlineDirective []Dire
 	if err != nil {
 		return
 	}
-	return ParseDirectiveFromBody(body)
+	errs := parseDirectivesFromBody(filename, body, &directives, &inlineDirective)
+	err = Errors("can not parse directive", errs)
+	return
 }
 
-// ParseDirectiveFromBody reads directives from body and returns the parsed directives.
+// ParseDirectiveFromBody reads directives from body and returns the parsed directives. The positions of the directives
+// have no filename.
 func ParseDirectiveFromBody(body []byte) (directives, inlineDirective []Directive, err error) {
-	errs := parseDirectivesFromBody(body, &directives, &inlineDirective)
+	errs := parseDirectivesFromBody("", body, &directives, &inlineDirective)
 	err = Errors("can not parse directive", errs)
 	return
 }
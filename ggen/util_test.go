@@ -1,6 +1,9 @@
 package ggen
 
 import (
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"go/types"
 	"testing"
 
@@ -19,6 +22,10 @@ func TestBuiltinTypes(t *testing.T) {
 	m := parseBuiltinTypes(pkg)
 	require.Equal(t, types.Int, m["int"].(*types.Basic).Kind())
 	require.Equal(t, "Error", m["error"].Underlying().(*types.Interface).Method(0).Name())
+
+	m = parseBuiltinTypes(nil)
+	require.Equal(t, types.Int, m["int"].(*types.Basic).Kind())
+	require.Equal(t, "Error", m["error"].Underlying().(*types.Interface).Method(0).Name())
 }
 
 func TestParseGoBuild(t *testing.T) {
@@ -84,3 +91,20 @@ func TestParseDirective(t *testing.T) {
 		}, directive)
 	})
 }
+
+func TestProcessDocText(t *testing.T) {
+	src := `package a
+
+// A is a type.
+// +gen:a
+//
+// More about A.
+// +gen:b arg
+type A int
+`
+	file, err := parser.ParseFile(token.NewFileSet(), "a.go", src, parser.ParseComments)
+	require.NoError(t, err)
+	doc := file.Decls[0].(*ast.GenDecl).Doc
+	require.Equal(t, "A is a type.\n\nMore about A.\n", processDocText(doc))
+	require.Equal(t, "", processDocText(nil))
+}
@@ -0,0 +1,190 @@
+package ggen
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const defaultWatchInterval = time.Second
+
+// Watch generates files like Start, then keeps running and polls the directories of the loaded packages. When a
+// non-generated Go file changes, it regenerates the packages that are affected by the change: the changed packages and
+// the packages importing them. Only plugins including any of these packages are run again. Watch returns when the
+// context is done. Errors of the subsequent runs are logged without stopping, and the packages of a failed run are
+// regenerated again on the next change.
+func Watch(ctx context.Context, cfg Config, patterns ...string) error {
+	interval := cfg.WatchInterval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	ng := newEngineFromConfig(&cfg)
+	if _, err := ng.start(ctx, cfg, patterns...); err != nil {
+		return err
+	}
+	w := newWatcher(ng)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		affected := w.poll()
+		if len(affected) == 0 {
+			continue
+		}
+		if logger.Enabled(DebugLevel) {
+			for _, pkgPath := range sortedKeys(affected) {
+				logger.Debug("affected package", "pkg", pkgPath)
+			}
+		}
+		logger.Info("regenerating", "packages", len(affected))
+
+		ng = newEngine(logger)
+		ng.onlyPackages = affected
+		if _, err := ng.start(ctx, cfg, patterns...); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.Error("regenerating failed", err)
+			// keep watching the previous packages
+			w.failed = affected
+			continue
+		}
+		w = newWatcher(ng)
+	}
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+type watcher struct {
+	cleanedFileNames map[string]bool
+
+	// dir2pkgs maps directories to the packages inside them
+	dir2pkgs map[string][]*packages.Package
+	// importers maps each package path to the packages directly importing it
+	importers map[string][]string
+
+	files map[string]fileStat
+
+	// failed are the packages of the last failed run
+	failed map[string]bool
+}
+
+func newWatcher(ng *engine) *watcher {
+	w := &watcher{
+		cleanedFileNames: ng.cleanedFileNames,
+		dir2pkgs:         make(map[string][]*packages.Package),
+		importers:        make(map[string][]string),
+	}
+	for _, pkg := range ng.availablePkgs {
+		dir := getPackageDir(pkg)
+		w.dir2pkgs[dir] = append(w.dir2pkgs[dir], pkg)
+	}
+	packages.Visit(ng.availablePkgs, func(pkg *packages.Package) bool {
+		for _, imp := range pkg.Imports {
+			w.importers[imp.PkgPath] = append(w.importers[imp.PkgPath], pkg.PkgPath)
+		}
+		return true
+	}, nil)
+	w.files = w.snapshot()
+	return w
+}
+
+// poll takes a new snapshot and returns the packages to regenerate: the packages affected by the changes since the
+// previous snapshot, together with the failed packages. It returns nil if nothing changed.
+func (w *watcher) poll() map[string]bool {
+	files := w.snapshot()
+	changedDirs := w.changedDirs(files)
+	w.files = files
+	if len(changedDirs) == 0 {
+		return nil
+	}
+	affected := w.affectedPackages(changedDirs)
+	for pkgPath := range w.failed {
+		affected[pkgPath] = true
+	}
+	return affected
+}
+
+// snapshot lists the non-generated Go files in the watched directories.
+func (w *watcher) snapshot() map[string]fileStat {
+	files := make(map[string]fileStat)
+	for dir := range w.dir2pkgs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// the directory may be removed, it is reported as changed
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(name, ".go") ||
+				strings.HasSuffix(name, "_test.go") || w.cleanedFileNames[name] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			files[filepath.Join(dir, name)] = fileStat{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return files
+}
+
+// changedDirs compares the new snapshot with the previous one.
+func (w *watcher) changedDirs(files map[string]fileStat) map[string]bool {
+	dirs := make(map[string]bool)
+	for file, stat := range files {
+		if prev, ok := w.files[file]; !ok || prev != stat {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	for file := range w.files {
+		if _, ok := files[file]; !ok {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	return dirs
+}
+
+// affectedPackages returns the packages in the changed directories and all packages transitively importing them.
+func (w *watcher) affectedPackages(changedDirs map[string]bool) map[string]bool {
+	affected := make(map[string]bool)
+	var queue []string
+	for dir := range changedDirs {
+		for _, pkg := range w.dir2pkgs[dir] {
+			queue = append(queue, pkg.PkgPath)
+		}
+	}
+	for len(queue) > 0 {
+		pkgPath := queue[0]
+		queue = queue[1:]
+		if affected[pkgPath] {
+			continue
+		}
+		affected[pkgPath] = true
+		queue = append(queue, w.importers[pkgPath]...)
+	}
+	return affected
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+package ggen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	dirA := filepath.Join(dir, "a")
+	dirB := filepath.Join(dir, "b")
+	dirC := filepath.Join(dir, "c")
+	writeFile := func(file, body string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		require.NoError(t, os.WriteFile(file, []byte(body), 0644))
+	}
+	writeFile(filepath.Join(dirA, "a.go"), "package a\n")
+	writeFile(filepath.Join(dirB, "b.go"), "package b\n")
+	writeFile(filepath.Join(dirC, "c.go"), "package c\n")
+
+	// b imports a, c is independent
+	pkgA := &packages.Package{PkgPath: "a", GoFiles: []string{filepath.Join(dirA, "a.go")}}
+	pkgB := &packages.Package{PkgPath: "b", GoFiles: []string{filepath.Join(dirB, "b.go")},
+		Imports: map[string]*packages.Package{"a": pkgA}}
+	pkgC := &packages.Package{PkgPath: "c", GoFiles: []string{filepath.Join(dirC, "c.go")}}
+	ng := &engine{
+		availablePkgs:    []*packages.Package{pkgA, pkgB, pkgC},
+		cleanedFileNames: map[string]bool{"zz_generated.mock.go": true},
+	}
+	w := newWatcher(ng)
+
+	t.Run("ignore generated and test files", func(t *testing.T) {
+		writeFile(filepath.Join(dirA, "zz_generated.mock.go"), "package a\n")
+		writeFile(filepath.Join(dirA, "a_test.go"), "package a\n")
+		require.Empty(t, w.changedDirs(w.snapshot()))
+	})
+	t.Run("changed package and its importers", func(t *testing.T) {
+		future := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dirA, "a.go"), future, future))
+		changedDirs := w.changedDirs(w.snapshot())
+		require.Equal(t, map[string]bool{dirA: true}, changedDirs)
+		require.Equal(t, map[string]bool{"a": true, "b": true}, w.affectedPackages(changedDirs))
+	})
+	t.Run("removed file", func(t *testing.T) {
+		w.files = w.snapshot()
+		require.NoError(t, os.Remove(filepath.Join(dirC, "c.go")))
+		changedDirs := w.changedDirs(w.snapshot())
+		require.Equal(t, map[string]bool{dirC: true}, changedDirs)
+		require.Equal(t, map[string]bool{"c": true}, w.affectedPackages(changedDirs))
+	})
+	t.Run("failed packages are retried on the next change", func(t *testing.T) {
+		writeFile(filepath.Join(dirC, "c.go"), "package c\n")
+		w.files = w.snapshot()
+		future := time.Now().Add(2 * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dirA, "a.go"), future, future))
+		w.failed = w.poll()
+		require.Equal(t, map[string]bool{"a": true, "b": true}, w.failed)
+		require.Nil(t, w.poll(), "nothing changed")
+
+		writeFile(filepath.Join(dirC, "c.go"), "package c\n\nvar _ = 0\n")
+		require.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, w.poll())
+	})
+}
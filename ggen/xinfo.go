@@ -1,6 +1,7 @@
 package ggen
 
 import (
+	"fmt"
 	"go/ast"
 	"go/token"
 	"go/types"
@@ -44,27 +45,66 @@ type Directive struct {
 	Cmd string // foo:pkg
 	Arg string // sample,baz
 
-	Item Positioner // the item that the directive is attached to
+	// Item is the item that the directive is attached to: the types.Object of the declaration (type, func, method,
+	// field, const or var), or its *ast.Ident if it is not type-checked. It is nil for package-level directives.
+	Item Positioner
+
+	// Pos is the position of the directive in the loaded packages. It is only set for directives attached to items,
+	// because package-level directives are parsed before loading.
+	Pos token.Pos
+
+	// Position is the position of the directive in its file, pointing to the "+" (or "go:build").
+	Position token.Position
 }
 
 func (d Directive) String() string {
 	return d.Raw
 }
 
+// Errorf returns an error prefixed with the position of the directive, like "file.go:12:4: msg", so editors can jump
+// to it.
+func (d Directive) Errorf(format string, args ...any) error {
+	return Errorf(nil, "%v: %v", d.location(), fmt.Sprintf(format, args...))
+}
+
+// location returns the position of the directive, or the directive itself if the position is unknown.
+func (d Directive) location() string {
+	if !d.Position.IsValid() {
+		return "directive " + d.Raw
+	}
+	return d.Position.String()
+}
+
+// argPosition returns the position of the byte at the given offset in the argument.
+func (d Directive) argPosition(offset int) token.Position {
+	pos := d.Position
+	if pos.IsValid() {
+		// Raw is trimmed, the argument is at its end
+		delta := len(d.Raw) - len(d.Arg) + offset
+		pos.Offset += delta
+		pos.Column += delta
+	}
+	return pos
+}
+
 func (d Directive) IsPackageLevel() bool {
 	return d.Item == nil
 }
 
-// ParseArgs parse directive argument using the standard "flag" package format. Example:
+// GetArgs splits the directive argument into arguments for the standard "flag" package, with quotes and escapes
+// removed (see TokenizeArgs). Example:
 //
-// // +ggen:sample -name=Alice DoSomething
+//	// +ggen:sample -name="Alice M" DoSomething
 func (d Directive) GetArgs() ([]string, error) {
-	if d.Arg == "" {
-		return nil, nil
+	tokens, err := TokenizeArgs(d.Arg)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
 	}
-	// TODO(iolivernguyen): handle escape
-	// // +ggen:sample -name="Alice M"
-	return strings.Split(d.Arg, " "), nil
+	args := make([]string, len(tokens))
+	for i, token := range tokens {
+		args[i] = token.Text
+	}
+	return args, nil
 }
 
 type Directives []Directive
@@ -147,7 +187,7 @@ func (x *extendedInfo) AddPackage(pkg *packages.Package) error {
 
 func (x *extendedInfo) addFile(pkg *packages.Package, file *ast.File) error {
 	var genDoc *ast.CommentGroup
-	processDocFunc := func(doc, cmt *ast.CommentGroup, fallback bool) *declaration {
+	processDocFunc := func(ident *ast.Ident, doc, cmt *ast.CommentGroup, fallback bool) *declaration {
 		if fallback {
 			if doc == nil {
 				doc = genDoc
@@ -155,10 +195,21 @@ func (x *extendedInfo) addFile(pkg *packages.Package, file *ast.File) error {
 		} else {
 			genDoc = nil
 		}
-		comment, err := processDoc(doc, cmt)
+		comment, err := processDoc(x.Fset, doc, cmt)
 		if err != nil {
 			logger.Debug("error while processing doc", "err", err)
 		}
+
+		// attach the directives to the declared object, or to the identifier if it is not type-checked
+		var item Positioner = ident
+		if pkg.TypesInfo != nil {
+			if obj := pkg.TypesInfo.ObjectOf(ident); obj != nil {
+				item = obj
+			}
+		}
+		for i := range comment.Directives {
+			comment.Directives[i].Item = item
+		}
 		return &declaration{
 			Pkg:     pkg,
 			Comment: comment,
@@ -202,7 +253,7 @@ func (x *extendedInfo) addFile(pkg *packages.Package, file *ast.File) error {
 
 		case *ast.FuncDecl:
 			ident := node.Name
-			setDecl(ident, processDocFunc(node.Doc, nil, false))
+			setDecl(ident, processDocFunc(ident, node.Doc, nil, false))
 			positions[ident.NamePos] = ident
 
 		case *ast.GenDecl:
@@ -217,25 +268,25 @@ func (x *extendedInfo) addFile(pkg *packages.Package, file *ast.File) error {
 		case *ast.ImportSpec:
 			if node.Name != nil {
 				ident := node.Name
-				setDecl(ident, processDocFunc(node.Doc, node.Comment, true))
+				setDecl(ident, processDocFunc(ident, node.Doc, node.Comment, true))
 				positions[ident.Pos()] = ident
 			}
 
 		case *ast.TypeSpec:
 			ident := node.Name
 
-			setDecl(ident, processDocFunc(node.Doc, node.Comment, true))
+			setDecl(ident, processDocFunc(ident, node.Doc, node.Comment, true))
 			positions[ident.NamePos] = ident
 
 		case *ast.ValueSpec:
 			for _, ident := range node.Names {
-				setDecl(ident, processDocFunc(node.Doc, node.Comment, true))
+				setDecl(ident, processDocFunc(ident, node.Doc, node.Comment, true))
 				positions[ident.NamePos] = ident
 			}
 
 		case *ast.Field:
 			for _, ident := range node.Names {
-				setDecl(ident, processDocFunc(node.Doc, node.Comment, false))
+				setDecl(ident, processDocFunc(ident, node.Doc, node.Comment, false))
 				positions[ident.NamePos] = ident
 			}
 		}
@@ -1,28 +1,85 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/iolivernguyen/ggen/ggen"
 	"github.com/iolivernguyen/ggen/plugins/sample"
 )
 
+var flConfig = flag.String("config", "", "config file (default to ggen.yaml, ggen.yml or ggen.json, looked up from the current directory to the module root)")
 var flClean = flag.Bool("clean", false, "clean generated files without generating new files")
+var flRemoveOrphans = flag.Bool("remove-orphans", false, "remove generated files of unregistered plugins or files no longer generated")
+var flDryRun = flag.Bool("dry-run", false, "report files that would be generated or deleted without writing them")
+var flCheck = flag.Bool("check", false, "fail with a diff if generated files are out of date, without writing them")
+var flMultiPass = flag.Bool("multi-pass", false, "run plugins in stages, so plugins can see the code generated by their dependencies")
+var flExternal = flag.String("external", "", "comma separated list of external plugins, each NAME runs the executable ggen-plugin-NAME")
+var flTemplates = flag.String("templates", "", "comma separated list of template plugins (.ggen.tmpl files, glob patterns or directories)")
 var flPlugin = flag.String("plugin", "", "comma separated list of plugins for generating (default to all plugins)")
+var flCache = flag.String("cache", "", "cache file for skipping packages whose sources have not changed since the last run")
+var flManifest = flag.String("manifest", "", "manifest file listing every generated file (example: ggen.manifest.json)")
+var flOutput = flag.String("output", "", "write generated files to a directory, a .zip or a .tar archive instead of the source tree")
+var flWatch = flag.Bool("watch", false, "keep running and regenerate when source files change")
+var flWatchInterval = flag.Duration("watch-interval", time.Second, "polling interval for -watch")
+var flTimeout = flag.Duration("timeout", 0, "stop generating after the given duration (example: 5m)")
 var flNamespace = flag.String("namespace", "", "github.com/myproject")
 var flVerbose = flag.Int("verbose", 0, "enable verbosity (0: info, 4: debug, 8: more debug)")
+var flOpts optionsFlag
 
-func usage() {
+func init() {
+	flag.Var(&flOpts, "opt", "plugin option in the form plugin.key=value (repeatable)")
+}
+
+// optionsFlag collects the -opt flags.
+type optionsFlag []string
+
+func (f *optionsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *optionsFlag) Set(s string) error {
+	if _, _, _, err := ggen.ParseOptionFlag(s); err != nil {
+		return err
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+func usage(plugins []ggen.Plugin) {
 	const text = `
-Usage: ggen [OPTION] PATTERN ...
+Usage: ggen [OPTION] [PATTERN ...]
+
+Patterns default to the patterns of the config file.
 
 Options:
 `
-	fmt.Print(text[1:])
+	fmt.Fprint(flag.CommandLine.Output(), text[1:])
 	flag.PrintDefaults()
+	printPluginOptions(plugins)
+}
+
+func printPluginOptions(plugins []ggen.Plugin) {
+	w := flag.CommandLine.Output()
+	for _, plugin := range plugins {
+		c, ok := plugin.(ggen.Configurable)
+		if !ok || len(c.Options()) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nOptions of plugin %v (-opt %v.KEY=VALUE):\n", plugin.Name(), plugin.Name())
+		for _, opt := range c.Options() {
+			fmt.Fprintf(w, "  %v %v\n    \t%v", opt.Name, opt.Type, opt.Usage)
+			if opt.Default != "" {
+				fmt.Fprintf(w, " (default %q)", opt.Default)
+			}
+			fmt.Fprintln(w)
+		}
+	}
 }
 
 func main() {
@@ -32,28 +89,209 @@ func main() {
 }
 
 func Start(plugins ...ggen.Plugin) {
+	flag.Usage = func() { usage(plugins) }
 	flag.Parse()
 	patterns := flag.Args()
-	if len(patterns) == 0 {
-		usage()
-		os.Exit(2)
+	if *flExternal != "" {
+		for _, name := range strings.Split(*flExternal, ",") {
+			plugins = append(plugins, ggen.NewExternalPlugin(name))
+		}
+	}
+	if *flTemplates != "" {
+		for _, pattern := range strings.Split(*flTemplates, ",") {
+			templates, err := ggen.LoadTemplatePlugins(pattern)
+			must(err)
+			if len(templates) == 0 {
+				must(fmt.Errorf("no template matches %v", pattern))
+			}
+			for _, pl := range templates {
+				plugins = append(plugins, pl)
+			}
+		}
 	}
 
 	cfg := ggen.Config{
 		LogLevel:      -ggen.LogLevel(*flVerbose),
 		CleanOnly:     *flClean,
-		Namespace:     *flNamespace,
+		RemoveOrphans: *flRemoveOrphans,
+		DryRun:        *flDryRun,
+		Check:         *flCheck,
+		MultiPass:     *flMultiPass,
+		CacheFile:     *flCache,
+		ManifestFile:  *flManifest,
+		WatchInterval: *flWatchInterval,
 		GoimportsArgs: []string{}, // example: -local github.com/foo
 	}
 	cfg.RegisterPlugin(plugins...)
+
+	// the config file is applied first, then the flags override it
+	configFile, err := loadConfigFile()
+	must(err)
+	if configFile != nil {
+		must(configFile.Apply(&cfg))
+		if len(patterns) == 0 {
+			patterns = configFile.Patterns
+			cfg.Dir = configFile.Dir()
+		}
+	}
+	if len(patterns) == 0 {
+		usage(plugins)
+		os.Exit(2)
+	}
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["namespace"] {
+		cfg.Namespace = *flNamespace
+	}
+	for _, opt := range flOpts {
+		plugin, key, value, _ := ggen.ParseOptionFlag(opt)
+		cfg.SetPluginOption(plugin, key, value)
+	}
 	if *flPlugin != "" {
 		pluginNames := strings.Split(*flPlugin, ",")
+		cfg.EnabledPlugins = nil
 		for _, name := range pluginNames {
 			cfg.EnablePlugin(name)
 		}
 	}
 
-	must(ggen.Start(cfg, patterns...))
+	// the output is closed explicitly before exiting, deferred calls do not run on os.Exit
+	closeOutput := func() error { return nil }
+	if *flOutput != "" {
+		output, closeFn, err := openOutput(*flOutput)
+		must(err)
+		cfg.Output, closeOutput = output, closeFn
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *flWatch {
+		err = ggen.Watch(ctx, cfg, patterns...)
+		if closeErr := closeOutput(); err == nil {
+			err = closeErr
+		}
+		must(err)
+		return
+	}
+	if *flTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *flTimeout)
+		defer cancel()
+	}
+
+	result, err := ggen.StartContext(ctx, cfg, patterns...)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	var staleErr *ggen.StaleError
+	if errors.As(err, &staleErr) {
+		printStale(staleErr)
+		os.Exit(1)
+	}
+	must(err)
+	if cfg.DryRun {
+		printDryRun(result)
+	} else {
+		printResult(result)
+	}
+}
+
+func loadConfigFile() (*ggen.ConfigFile, error) {
+	configPath := *flConfig
+	if configPath == "" {
+		var err error
+		configPath, err = ggen.FindConfigFile(".")
+		if err != nil || configPath == "" {
+			return nil, err
+		}
+	}
+	return ggen.LoadConfigFile(configPath)
+}
+
+// openOutput returns an output for the given directory or archive. The generated paths are relative to the current
+// directory.
+func openOutput(path string) (_ ggen.OutputFS, closeFn func() error, _ error) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".zip", ".tar":
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		var output interface {
+			ggen.OutputFS
+			Close() error
+		}
+		if filepath.Ext(path) == ".zip" {
+			output = ggen.NewZipFS(file, pwd)
+		} else {
+			output = ggen.NewTarFS(file, pwd)
+		}
+		return output, func() error {
+			if err := output.Close(); err != nil {
+				return err
+			}
+			return file.Close()
+		}, nil
+	default:
+		return ggen.NewDirFS(path, pwd), func() error { return nil }, nil
+	}
+}
+
+func printResult(result *ggen.Result) {
+	if len(result.Generated) != 0 {
+		fmt.Println("Generated files:")
+		for _, filePath := range result.Generated {
+			fmt.Printf("\t%v\n", relPath(filePath))
+		}
+	}
+	if len(result.Deleted) != 0 {
+		fmt.Println("Deleted files:")
+		for _, filePath := range result.Deleted {
+			fmt.Printf("\t%v\n", relPath(filePath))
+		}
+	}
+	if *flVerbose > 0 {
+		for _, pl := range result.Plugins {
+			fmt.Printf("plugin %v: %v package(s), %v cached, %v file(s) in %v\n",
+				pl.Name, pl.Packages, pl.Cached, pl.Files, pl.Duration.Round(time.Millisecond))
+		}
+	}
+	fmt.Printf("%v file(s) generated (%v unchanged), %v deleted in %v\n",
+		len(result.Generated), len(result.Unchanged), len(result.Deleted), result.Timings.Total.Round(time.Millisecond))
+}
+
+func printDryRun(result *ggen.Result) {
+	if len(result.Files) == 0 {
+		fmt.Println("No files would be changed")
+		return
+	}
+	fmt.Println("Files would be changed:")
+	for _, file := range result.Files {
+		fmt.Printf("\t%-6v %v\n", file.Action, relPath(file.Path))
+	}
+}
+
+func printStale(err *ggen.StaleError) {
+	for _, file := range err.Files {
+		fmt.Print(file.Diff)
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
+func relPath(filePath string) string {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return filePath
+	}
+	rel, err := filepath.Rel(pwd, filePath)
+	if err != nil {
+		return filePath
+	}
+	return "./" + rel
 }
 
 func must(err error) {
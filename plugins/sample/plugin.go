@@ -5,16 +5,30 @@ import (
 )
 
 func New() ggen.Plugin {
-	return plugin{}
+	return &plugin{}
 }
 
-var _ ggen.Filterer = plugin{}
+var _ ggen.Filterer = &plugin{}
+var _ ggen.Configurable = &plugin{}
 
-type plugin struct{}
+type plugin struct {
+	logObjects bool
+}
+
+func (p *plugin) Name() string { return "sample" }
+
+func (p *plugin) Options() []ggen.Option {
+	return []ggen.Option{
+		{Name: "objects", Type: ggen.OptionBool, Default: "true", Usage: "log the objects of each package"},
+	}
+}
 
-func (p plugin) Name() string { return "sample" }
+func (p *plugin) Configure(opts ggen.Options) error {
+	p.logObjects = opts.Bool("objects")
+	return nil
+}
 
-func (p plugin) Filter(ft ggen.FilterEngine) error {
+func (p *plugin) Filter(ft ggen.FilterEngine) error {
 	for _, pkg := range ft.ParsingPackages() {
 		ft.IncludePackage(pkg.PkgPath)
 		ft.Debug("include package", "pkg", pkg.PkgPath)
@@ -22,10 +36,13 @@ func (p plugin) Filter(ft ggen.FilterEngine) error {
 	return nil
 }
 
-func (p plugin) Generate(ng ggen.Engine) error {
+func (p *plugin) Generate(ng ggen.Engine) error {
 	pkgs := ng.GeneratingPackages()
 	for _, gpkg := range pkgs {
 		ng.Debug("generate package", "pkg", gpkg.Package.PkgPath)
+		if !p.logObjects {
+			continue
+		}
 		objects := gpkg.GetObjects()
 		for _, obj := range objects {
 			ng.Debug("  object", "name", obj.Name(), "type", obj.Type())
@@ -1,15 +1,21 @@
 package tests_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"go/types"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/iolivernguyen/ggen/ggen"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/go/packages"
 )
 
 const testPath = "github.com/iolivernguyen/ggen/tests"
@@ -66,7 +72,7 @@ func TestObjects(t *testing.T) {
 	reset()
 	cfg := ggen.Config{}
 	cfg.RegisterPlugin(mock)
-	err := ggen.Start(cfg, testPatterns)
+	_, err := ggen.Start(cfg, testPatterns)
 	require.NoError(t, err)
 
 	ng := mock.ng
@@ -82,6 +88,20 @@ func TestObjects(t *testing.T) {
 		directives := ng.GetDirectives(objects[0])
 		require.Len(t, directives, 1)
 		require.Equal(t, "ggen:a", directives[0].Cmd)
+		require.Equal(t, objects[0], directives[0].Item)
+		require.False(t, directives[0].IsPackageLevel())
+	}
+	{
+		directives := ng.GetAllDirectivesByPackage(pkg)
+		require.Len(t, directives, 4)
+		require.Equal(t, "ggen:sample", directives[0].Cmd)
+		require.True(t, directives[0].IsPackageLevel())
+		require.Equal(t, "ggen:last", directives[1].Cmd)
+		require.True(t, directives[1].IsPackageLevel())
+		require.Equal(t, "ggen:a", directives[2].Cmd)
+		require.Equal(t, objects[0], directives[2].Item)
+		require.Equal(t, "ggen:b", directives[3].Cmd)
+		require.Equal(t, objects[1], directives[3].Item)
 	}
 	{
 		directives := ng.GetDirectives(objects[1])
@@ -108,6 +128,57 @@ func TestObjects(t *testing.T) {
 	}
 }
 
+func TestDirectiveItems(t *testing.T) {
+	reset()
+	cfg := ggen.Config{}
+	cfg.RegisterPlugin(mock)
+	_, err := ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+
+	ng := mock.ng
+	pkg := ng.GetPackageByPath(testPath + "/two")
+	require.NotNil(t, pkg)
+	scope := pkg.Types.Scope()
+	typT := scope.Lookup("T").Type().(*types.Named)
+	typI := scope.Lookup("I").Type().Underlying().(*types.Interface)
+
+	items := map[string]types.Object{
+		"item:func":             scope.Lookup("F"),
+		"item:field":            typT.Underlying().(*types.Struct).Field(0),
+		"item:method":           typT.Method(0),
+		"item:interface-method": typI.Method(0),
+		"item:const":            scope.Lookup("C"),
+	}
+	for cmd, obj := range items {
+		require.NotNil(t, obj, cmd)
+		directives := ng.GetDirectives(obj)
+		require.Len(t, directives, 1, cmd)
+		require.Equal(t, cmd, directives[0].Cmd)
+		require.Equal(t, obj, directives[0].Item, cmd)
+	}
+	for _, name := range []string{"a", "b"} {
+		obj := scope.Lookup(name)
+		directives := ng.GetDirectives(obj)
+		require.Len(t, directives, 1, name)
+		require.Equal(t, "item:var", directives[0].Cmd)
+		require.Equal(t, obj, directives[0].Item, "each name of the spec owns its directive")
+	}
+
+	var cmds []string
+	var objs []types.Object
+	for _, d := range ng.GetAllDirectivesByPackage(pkg) {
+		cmds = append(cmds, d.Cmd)
+		objs = append(objs, d.Item.(types.Object))
+	}
+	require.Equal(t, []string{
+		"item:func", "item:field", "item:method", "item:interface-method", "item:const", "item:var", "item:var",
+	}, cmds)
+	require.Equal(t, []types.Object{
+		items["item:func"], items["item:field"], items["item:method"], items["item:interface-method"], items["item:const"],
+		scope.Lookup("a"), scope.Lookup("b"),
+	}, objs)
+}
+
 func TestGenerate(t *testing.T) {
 	reset()
 	var pkgs []*ggen.GeneratingPackage
@@ -128,7 +199,7 @@ func TestGenerate(t *testing.T) {
 
 	cfg := ggen.Config{}
 	cfg.RegisterPlugin(mock)
-	err := ggen.Start(cfg, testPatterns)
+	_, err := ggen.Start(cfg, testPatterns)
 	require.NoError(t, err)
 
 	output, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
@@ -147,7 +218,7 @@ func TestClean(t *testing.T) {
 	reset()
 	cfg := ggen.Config{CleanOnly: true}
 	cfg.RegisterPlugin(mock)
-	err := ggen.Start(cfg, testPatterns)
+	_, err := ggen.Start(cfg, testPatterns)
 	require.NoError(t, err)
 
 	output, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
@@ -168,7 +239,7 @@ func TestInclude(t *testing.T) {
 
 	cfg := ggen.Config{}
 	cfg.RegisterPlugin(mock)
-	err := ggen.Start(cfg, testPatterns)
+	_, err := ggen.Start(cfg, testPatterns)
 	require.NoError(t, err)
 
 	expecteds := []string{
@@ -182,6 +253,802 @@ func TestInclude(t *testing.T) {
 	}
 }
 
+func TestDryRun(t *testing.T) {
+	reset()
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			if pkg.Package.PkgPath == testPath+"/one" {
+				mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+			}
+		}
+		return nil
+	}
+	cfg := ggen.Config{DryRun: true}
+	cfg.RegisterPlugin(mock)
+	result, err := ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+
+	require.Len(t, result.Files, 1)
+	file := result.Files[0]
+	require.Equal(t, ggen.FileCreated, file.Action)
+	require.Equal(t, "zz_generated.mock.go", filepath.Base(file.Path))
+	require.Contains(t, string(file.Body), "package one\n")
+	require.Contains(t, string(file.Body), "var _ = 0\n")
+
+	output, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
+		CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "", string(output))
+}
+
+func TestCheck(t *testing.T) {
+	reset()
+	var content string
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			if pkg.Package.PkgPath == testPath+"/one" {
+				mustWrite(pkg.GetPrinter(), []byte(content))
+			}
+		}
+		return nil
+	}
+	start := func(check bool) (*ggen.Result, error) {
+		cfg := ggen.Config{Check: check}
+		cfg.RegisterPlugin(mock)
+		return ggen.Start(cfg, testPatterns)
+	}
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}()
+
+	content = "var _ = 0\n"
+	_, err := start(true)
+	var staleErr *ggen.StaleError
+	require.ErrorAs(t, err, &staleErr)
+	require.Len(t, staleErr.Files, 1)
+	require.Equal(t, ggen.FileCreated, staleErr.Files[0].Action)
+	require.Contains(t, staleErr.Files[0].Diff, "+var _ = 0\n")
+
+	_, err = start(false)
+	require.NoError(t, err)
+	result, err := start(true)
+	require.NoError(t, err)
+	require.Len(t, result.Files, 0)
+
+	content = "var _ = 1\n"
+	_, err = start(true)
+	require.ErrorAs(t, err, &staleErr)
+	require.Len(t, staleErr.Files, 1)
+	require.Equal(t, ggen.FileUpdated, staleErr.Files[0].Action)
+	require.Contains(t, staleErr.Files[0].Diff, "-var _ = 0\n+var _ = 1\n")
+}
+
+type versionedPlugin struct {
+	*mockPlugin
+}
+
+func (p versionedPlugin) Version() string { return "v1" }
+
+func TestCache(t *testing.T) {
+	reset()
+	var generated []string
+	mock.generate = func(ng ggen.Engine) error {
+		generated = generated[:0]
+		for _, pkg := range ng.GeneratingPackages() {
+			generated = append(generated, pkg.PkgPath)
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		return nil
+	}
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	start := func() {
+		cfg := ggen.Config{CacheFile: cacheFile}
+		cfg.RegisterPlugin(versionedPlugin{mock})
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}()
+
+	start()
+	require.Len(t, generated, 4)
+
+	generated = nil
+	start()
+	require.Len(t, generated, 0, "all packages are up to date")
+
+	output, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
+		CombinedOutput()
+	require.NoError(t, err)
+	expected := `
+./one/one-and-a-half/zz_generated.mock.go
+./one/zz_generated.mock.go
+./two/zz_generated.mock.go
+./zz_generated.mock.go
+`[1:]
+	require.Equal(t, expected, string(output))
+}
+
+// startCached runs the plugins with the cache file, and returns the packages generated by mock.
+func startCached(t *testing.T, cfg ggen.Config, plugins ...ggen.Plugin) []string {
+	var generated []string
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			generated = append(generated, pkg.PkgPath)
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		return nil
+	}
+	cfg.RegisterPlugin(plugins...)
+	_, err := ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+	return generated
+}
+
+type versionedConfigurablePlugin struct {
+	*configurablePlugin
+}
+
+func (p versionedConfigurablePlugin) Version() string { return "v1" }
+
+func TestCacheOptions(t *testing.T) {
+	reset()
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}()
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	start := func(style string) []string {
+		pl := versionedConfigurablePlugin{&configurablePlugin{mockPlugin: mock}}
+		cfg := ggen.Config{CacheFile: cacheFile, PluginOptions: map[string]map[string]string{"mock": {"style": style}}}
+		return startCached(t, cfg, pl)
+	}
+
+	require.Len(t, start("aaa"), 4)
+	require.Len(t, start("aaa"), 0, "all packages are up to date")
+	require.Len(t, start("bbb"), 4, "changing an option invalidates the cache")
+	require.Len(t, start("bbb"), 0)
+}
+
+type licensePlugin struct {
+	mockPlugin
+}
+
+func (p *licensePlugin) Name() string { return "license" }
+
+func (p *licensePlugin) PostProcess(filePath string, body []byte) ([]byte, error) {
+	return append(body, "// license\n"...), nil
+}
+
+func TestCachePostProcessors(t *testing.T) {
+	reset()
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}()
+	cfg := ggen.Config{CacheFile: filepath.Join(t.TempDir(), "cache.json")}
+
+	require.Len(t, startCached(t, cfg, versionedPlugin{mock}), 4)
+	require.Len(t, startCached(t, cfg, versionedPlugin{mock}, &licensePlugin{}), 4, "enabling a post-processor invalidates the cache")
+	body, err := os.ReadFile(filepath.Join("two", "zz_generated.mock.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(body), "// license\n")
+	require.Len(t, startCached(t, cfg, versionedPlugin{mock}, &licensePlugin{}), 0)
+}
+
+func TestCacheGoimports(t *testing.T) {
+	reset()
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}()
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	start := func(local string) []string {
+		cfg := ggen.Config{CacheFile: cacheFile, GoimportsArgs: []string{"-local", local}}
+		return startCached(t, cfg, versionedPlugin{mock})
+	}
+
+	require.Len(t, start("example.com/a"), 4)
+	require.Len(t, start("example.com/a"), 0, "all packages are up to date")
+	require.Len(t, start("example.com/b"), 4, "changing the goimports options invalidates the cache")
+}
+
+func TestResult(t *testing.T) {
+	reset()
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		return nil
+	}
+	orphan := filepath.Join("two", "zz_generated.removed.go")
+	require.NoError(t, os.WriteFile(orphan, []byte("// Code generated by ggen removed. DO NOT EDIT.\n\npackage two\n"), 0644))
+	defer func() { require.NoError(t, os.Remove(orphan)) }()
+	start := func(cfg ggen.Config) *ggen.Result {
+		cfg.RegisterPlugin(mock)
+		result, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+		return result
+	}
+	defer start(ggen.Config{CleanOnly: true})
+
+	result := start(ggen.Config{})
+	require.Len(t, result.Generated, 4)
+	require.Empty(t, result.Unchanged)
+	require.Equal(t, []ggen.PluginResult{{Name: "mock", Packages: 4, Files: 4, Duration: result.Plugins[0].Duration}}, result.Plugins)
+	require.Len(t, result.Warnings, 1)
+	require.Contains(t, result.Warnings[0], "orphaned generated file")
+	require.NotZero(t, result.Timings.Load)
+	require.NotZero(t, result.Timings.Total)
+
+	result = start(ggen.Config{})
+	require.Equal(t, result.Generated, result.Unchanged)
+	require.Empty(t, result.Files)
+
+	result = start(ggen.Config{CleanOnly: true})
+	require.Empty(t, result.Generated)
+	require.Len(t, result.Deleted, 4)
+}
+
+func TestOutput(t *testing.T) {
+	reset()
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		return nil
+	}
+	output := ggen.NewMemFS()
+	cfg := ggen.Config{Output: output}
+	cfg.RegisterPlugin(mock)
+	result, err := ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+	require.Equal(t, result.Generated, output.Files())
+
+	body, err := output.ReadFile(result.Generated[0])
+	require.NoError(t, err)
+	require.Contains(t, string(body), "var _ = 0\n")
+
+	files, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
+		CombinedOutput()
+	require.NoError(t, err)
+	require.Empty(t, string(files), "nothing is written to the source tree")
+}
+
+func TestOverrides(t *testing.T) {
+	reset()
+	var generated []string
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			generated = append(generated, pkg.PkgPath)
+		}
+		return nil
+	}
+	cfg := ggen.Config{
+		DryRun:    true,
+		Overrides: []ggen.DirOverride{{Dir: "one"}, {Dir: filepath.Join("one", "one-and-a-half"), Plugins: []string{"mock"}}},
+	}
+	cfg.RegisterPlugin(mock)
+	_, err := ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+	require.Equal(t, []string{testPath, testPath + "/one/one-and-a-half", testPath + "/two"}, generated)
+}
+
+type configurablePlugin struct {
+	*mockPlugin
+	style string
+}
+
+func (p *configurablePlugin) Options() []ggen.Option {
+	return []ggen.Option{{Name: "style", Type: ggen.OptionString, Default: "plain"}}
+}
+
+func (p *configurablePlugin) Configure(opts ggen.Options) error {
+	p.style = opts.String("style")
+	return nil
+}
+
+func TestPluginOptions(t *testing.T) {
+	reset()
+	start := func(options map[string]map[string]string) (*configurablePlugin, error) {
+		pl := &configurablePlugin{mockPlugin: mock}
+		cfg := ggen.Config{DryRun: true, PluginOptions: options}
+		cfg.RegisterPlugin(pl)
+		_, err := ggen.Start(cfg, testPatterns)
+		return pl, err
+	}
+
+	pl, err := start(nil)
+	require.NoError(t, err)
+	require.Equal(t, "plain", pl.style)
+
+	pl, err = start(map[string]map[string]string{"mock": {"style": "testify"}})
+	require.NoError(t, err)
+	require.Equal(t, "testify", pl.style)
+
+	_, err = start(map[string]map[string]string{"mock": {"color": "red"}, "other": {"a": "b"}})
+	require.ErrorContains(t, err, `plugin mock: unknown option "color"`)
+	require.ErrorContains(t, err, "options of plugin other: plugin not found")
+}
+
+type hooksPlugin struct {
+	*mockPlugin
+	calls       []string
+	stripHeader bool
+}
+
+func (p *hooksPlugin) Init(ctx context.Context, ng ggen.InitEngine) error {
+	p.calls = append(p.calls, "init")
+	return nil
+}
+
+func (p *hooksPlugin) PostProcess(filePath string, body []byte) ([]byte, error) {
+	p.calls = append(p.calls, "post-process "+filepath.Base(filePath))
+	if p.stripHeader {
+		body = bytes.Replace(body, []byte("// Code generated by ggen"), []byte("// Code generated by"), 1)
+	}
+	return append(body, "// post-processed\n"...), nil
+}
+
+func (p *hooksPlugin) Finalize(result *ggen.Result) error {
+	p.calls = append(p.calls, fmt.Sprintf("finalize %v", len(result.Files)))
+	return nil
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	reset()
+	pl := &hooksPlugin{mockPlugin: mock}
+	mock.filter = func(ng ggen.FilterEngine) error {
+		pl.calls = append(pl.calls, "filter")
+		ng.IncludePackage(testPath)
+		return nil
+	}
+	mock.generate = func(ng ggen.Engine) error {
+		pl.calls = append(pl.calls, "generate")
+		for _, pkg := range ng.GeneratingPackages() {
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		return nil
+	}
+	cfg := ggen.Config{DryRun: true}
+	cfg.RegisterPlugin(pl)
+	result, err := ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+	require.Equal(t, []string{"init", "filter", "generate", "post-process zz_generated.mock.go", "finalize 1"}, pl.calls)
+	require.Len(t, result.Files, 1)
+	require.True(t, strings.HasSuffix(string(result.Files[0].Body), "var _ = 0\n// post-processed\n"))
+
+	cfg = ggen.Config{DryRun: true}
+	cfg.RegisterPlugin(&hooksPlugin{mockPlugin: mock, stripHeader: true})
+	_, err = ggen.Start(cfg, testPatterns)
+	require.ErrorContains(t, err, "by plugin mock: the \"// Code generated by ggen <plugin>. DO NOT EDIT.\" header is removed")
+}
+
+type dependentPlugin struct {
+	mockPlugin
+}
+
+func (p *dependentPlugin) Name() string        { return "dependent" }
+func (p *dependentPlugin) DependsOn() []string { return []string{"mock"} }
+
+func TestMultiPass(t *testing.T) {
+	reset()
+	mock.filter = func(ng ggen.FilterEngine) error {
+		ng.IncludePackage(testPath)
+		return nil
+	}
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			mustWrite(pkg.GetPrinter(), []byte("type Generated int\n"))
+		}
+		return nil
+	}
+	start := func(multiPass bool) types.Object {
+		var obj types.Object
+		dependent := &dependentPlugin{}
+		dependent.filter = mock.filter
+		dependent.generate = func(ng ggen.Engine) error {
+			obj = ng.GetObjectByName(testPath, "Generated")
+			return nil
+		}
+		cfg := ggen.Config{DryRun: true, MultiPass: multiPass}
+		cfg.RegisterPlugin(mock, dependent)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+		return obj
+	}
+
+	require.Nil(t, start(false))
+	obj := start(true)
+	require.NotNil(t, obj)
+	require.Equal(t, "int", obj.Type().Underlying().String())
+}
+
+type versionedDependentPlugin struct {
+	*dependentPlugin
+}
+
+func (p versionedDependentPlugin) Version() string { return "v1" }
+
+type bumpedPlugin struct {
+	*mockPlugin
+	version string
+}
+
+func (p bumpedPlugin) Version() string { return p.version }
+
+func TestCacheMultiPass(t *testing.T) {
+	reset()
+	dependent := &dependentPlugin{}
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock, dependent)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}()
+	var generated []string
+	dependent.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			generated = append(generated, pkg.PkgPath)
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 1\n"))
+		}
+		return nil
+	}
+	cfg := ggen.Config{CacheFile: filepath.Join(t.TempDir(), "cache.json"), MultiPass: true}
+	start := func(version string) []string {
+		generated = nil
+		startCached(t, cfg, bumpedPlugin{mock, version}, versionedDependentPlugin{dependent})
+		return generated
+	}
+
+	require.Len(t, start("v1"), 4)
+	require.Len(t, start("v1"), 0, "all packages are up to date")
+	require.Len(t, start("v2"), 4, "bumping a dependency invalidates the dependent plugin")
+}
+
+const externalPluginEnv = "GGEN_TEST_EXTERNAL_PLUGIN"
+const externalDuplicateEnv = "GGEN_TEST_EXTERNAL_DUPLICATE"
+
+// TestMain runs the test binary as an external plugin when it is started by ggen.
+func TestMain(m *testing.M) {
+	if os.Getenv(externalPluginEnv) != "" {
+		if err := ggen.ServeExternalPlugin(generateExternal); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func generateExternal(req *ggen.ExternalRequest) ([]ggen.ExternalFile, error) {
+	var files []ggen.ExternalFile
+	for _, pkg := range req.Packages {
+		if len(pkg.Objects) == 0 {
+			return nil, fmt.Errorf("package %v has no objects", pkg.Name)
+		}
+		var b strings.Builder
+		for _, obj := range pkg.Objects {
+			if obj.Kind != "type" || obj.Fields == nil {
+				continue
+			}
+			var fields []string
+			for _, field := range obj.Fields {
+				fields = append(fields, field.Name+":"+field.Type)
+			}
+			fmt.Fprintf(&b, "// %v\nfunc (%v) Fields() []string { return strings.Fields(%q) }\n",
+				strings.TrimSpace(obj.Doc), obj.Name, strings.Join(fields, " "))
+			for _, d := range obj.Directives {
+				fmt.Fprintf(&b, "\n// directive %v at %v\n", d.Cmd, d.Position)
+			}
+		}
+		files = append(files, ggen.ExternalFile{PkgPath: pkg.PkgPath, Body: b.String()})
+		if os.Getenv(externalDuplicateEnv) != "" {
+			files = append(files, files[len(files)-1])
+		}
+	}
+	return files, nil
+}
+
+type externalPlugin struct {
+	*ggen.ExternalPlugin
+	include string
+}
+
+func (p *externalPlugin) Filter(ng ggen.FilterEngine) error {
+	ng.IncludePackage(p.include)
+	return nil
+}
+
+func TestExternalPlugin(t *testing.T) {
+	start := func(include string, env ...string) (*ggen.Result, error) {
+		pl := &externalPlugin{ExternalPlugin: ggen.NewExternalPlugin("ext"), include: include}
+		pl.Path = os.Args[0]
+		pl.Env = append([]string{externalPluginEnv + "=1"}, env...)
+		cfg := ggen.Config{DryRun: true}
+		cfg.RegisterPlugin(pl)
+		return ggen.Start(cfg, testPatterns)
+	}
+
+	result, err := start(testPath + "/one")
+	require.NoError(t, err)
+	require.Len(t, result.Files, 1)
+	require.Equal(t, "zz_generated.ext.go", filepath.Base(result.Files[0].Path))
+	body := string(result.Files[0].Body)
+	require.Contains(t, body, "import \"strings\"\n")
+	require.Contains(t, body, "// this is comment of A\nfunc (A) Fields() []string { return strings.Fields(\"Zero:struct{} One:int Two:string Three:bool\") }\n")
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.Contains(t, body, "// directive ggen:a at "+filepath.Join(wd, "one", "one.go")+":7:4\n")
+
+	_, err = start(testPath + "/one/one-and-a-half")
+	require.ErrorContains(t, err, "package oneahalf has no objects")
+
+	_, err = start(testPath+"/one", externalDuplicateEnv+"=1")
+	require.ErrorContains(t, err, "zz_generated.ext.go is returned more than once")
+}
+
+type declarerPlugin struct {
+	*mockPlugin
+	specs []ggen.DirectiveSpec
+}
+
+func (p *declarerPlugin) Directives() []ggen.DirectiveSpec { return p.specs }
+
+type sampleArgs struct {
+	Count int `ggen:"count"`
+}
+
+func TestDirectiveSchema(t *testing.T) {
+	reset()
+	start := func(specs ...ggen.DirectiveSpec) error {
+		cfg := ggen.Config{DryRun: true}
+		cfg.RegisterPlugin(&declarerPlugin{mockPlugin: mock, specs: specs})
+		_, err := ggen.Start(cfg, testPatterns)
+		return err
+	}
+	sample := ggen.DirectiveSpec{Cmd: "ggen:sample", On: []ggen.ItemKind{ggen.ItemPackage}}
+	last := ggen.DirectiveSpec{Cmd: "ggen:last"}
+	a := ggen.DirectiveSpec{Cmd: "ggen:a", On: []ggen.ItemKind{ggen.ItemType}}
+	b := ggen.DirectiveSpec{Cmd: "ggen:b", On: []ggen.ItemKind{ggen.ItemType}}
+	require.NoError(t, start(sample, last, a, b))
+
+	err := start(sample, last, a)
+	require.ErrorContains(t, err, filepath.Join("one", "one.go")+":22:4: unknown directive +ggen:b (did you mean +ggen:a?)")
+
+	b.On = []ggen.ItemKind{ggen.ItemField, ggen.ItemMethod}
+	err = start(sample, last, a, b)
+	require.ErrorContains(t, err, "directive +ggen:b can not be attached to a type (allowed: field, method)")
+
+	sample.Args = sampleArgs{}
+	err = start(sample, last, a, ggen.DirectiveSpec{Cmd: "ggen:b"})
+	require.ErrorContains(t, err, filepath.Join("one", "one.go")+":3:17: directive +ggen:sample 10: unknown key \"10\"")
+
+	// dependent does not declare its directives, but the ggen namespace is declared, so unknown commands are rejected
+	sample.Args = nil
+	cfg := ggen.Config{DryRun: true}
+	cfg.RegisterPlugin(&declarerPlugin{mockPlugin: mock, specs: []ggen.DirectiveSpec{sample, last, a}}, &dependentPlugin{})
+	_, err = ggen.Start(cfg, testPatterns)
+	require.ErrorContains(t, err, filepath.Join("one", "one.go")+":22:4: unknown directive +ggen:b (did you mean +ggen:a?)")
+
+	// the item namespace of tests/two is not declared, so its directives are not checked
+	cfg = ggen.Config{DryRun: true}
+	cfg.RegisterPlugin(&declarerPlugin{mockPlugin: mock, specs: []ggen.DirectiveSpec{sample, last, a, {Cmd: "ggen:b"}}}, &dependentPlugin{})
+	_, err = ggen.Start(cfg, testPatterns)
+	require.NoError(t, err)
+
+	cfg = ggen.Config{DryRun: true}
+	cfg.RegisterPlugin(&declarerPlugin{mockPlugin: mock, specs: []ggen.DirectiveSpec{sample, last, a, b}}, &dependentPlugin{})
+	_, err = ggen.Start(cfg, testPatterns)
+	require.ErrorContains(t, err, "directive +ggen:b can not be attached to a type (allowed: field, method)")
+}
+
+func TestHandwrittenFile(t *testing.T) {
+	reset()
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		return nil
+	}
+	handwritten := filepath.Join("two", "zz_generated.mock.go")
+	body := []byte("package two\n\n// handwritten\n")
+	require.NoError(t, os.WriteFile(handwritten, body, 0644))
+	defer func() { require.NoError(t, os.Remove(handwritten)) }()
+
+	for _, cleanOnly := range []bool{false, true} {
+		cfg := ggen.Config{CleanOnly: cleanOnly}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.ErrorContains(t, err, "refusing to delete")
+		require.ErrorContains(t, err, "not generated by ggen")
+
+		actual, err := os.ReadFile(handwritten)
+		require.NoError(t, err)
+		require.Equal(t, string(body), string(actual))
+	}
+	output, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
+		CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "./two/zz_generated.mock.go\n", string(output), "nothing is generated")
+}
+
+func TestOrphans(t *testing.T) {
+	reset()
+	orphans := []string{
+		filepath.Join("two", "zz_generated.removed.go"),
+		filepath.Join("one", "zz_generated.mock.renamed.go"),
+	}
+	require.NoError(t, os.WriteFile(orphans[0], []byte("// Code generated by ggen removed. DO NOT EDIT.\n\npackage two\n"), 0644))
+	require.NoError(t, os.WriteFile(orphans[1], []byte("// Code generated by ggen mock. DO NOT EDIT.\n\npackage one\n"), 0644))
+	defer func() {
+		for _, orphan := range orphans {
+			_ = os.Remove(orphan)
+		}
+	}()
+
+	start := func(removeOrphans bool) {
+		cfg := ggen.Config{RemoveOrphans: removeOrphans}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+	}
+	start(false)
+	for _, orphan := range orphans {
+		require.FileExists(t, orphan, "orphans are only reported")
+	}
+
+	cfg := ggen.Config{Check: true}
+	cfg.RegisterPlugin(mock)
+	_, err := ggen.Start(cfg, testPatterns)
+	var staleErr *ggen.StaleError
+	require.ErrorAs(t, err, &staleErr)
+	require.Len(t, staleErr.Files, 2, "orphans are stale in check mode")
+	for _, file := range staleErr.Files {
+		require.Equal(t, ggen.FileDeleted, file.Action)
+		require.FileExists(t, file.Path)
+	}
+
+	start(true)
+	for _, orphan := range orphans {
+		require.NoFileExists(t, orphan)
+	}
+}
+
+func TestOrphansOutsidePackages(t *testing.T) {
+	reset()
+	mock.generate = func(ng ggen.Engine) error {
+		printer, err := ng.GenerateFile("extra", filepath.Join("extra", "zz_extra.go"))
+		if err != nil {
+			return err
+		}
+		mustWrite(printer, []byte("var _ = 0\n"))
+		return printer.Close()
+	}
+	start := func(cfg ggen.Config) []string {
+		cfg.DryRun = true
+		cfg.RegisterPlugin(mock)
+		result, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+		return result.Warnings
+	}
+
+	warnings := start(ggen.Config{})
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "set ManifestFile to track them")
+	require.Contains(t, warnings[0], filepath.Join("tests", "extra"))
+
+	require.Empty(t, start(ggen.Config{ManifestFile: filepath.Join(t.TempDir(), "manifest.json")}))
+}
+
+func TestManifest(t *testing.T) {
+	reset()
+	extraFile := true
+	mock.generate = func(ng ggen.Engine) error {
+		for _, pkg := range ng.GeneratingPackages() {
+			mustWrite(pkg.GetPrinter(), []byte("var _ = 0\n"))
+		}
+		if extraFile {
+			printer, err := ng.GenerateFile("two", filepath.Join("two", "zz_extra.go"))
+			if err != nil {
+				return err
+			}
+			mustWrite(printer, []byte("var _ = 1\n"))
+			return printer.Close()
+		}
+		return nil
+	}
+	manifestFile := "manifest.json"
+	start := func() *ggen.Manifest {
+		cfg := ggen.Config{ManifestFile: manifestFile}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+
+		manifest, err := ggen.ReadManifest(manifestFile)
+		require.NoError(t, err)
+		return manifest
+	}
+	defer func() {
+		cfg := ggen.Config{CleanOnly: true}
+		cfg.RegisterPlugin(mock)
+		_, err := ggen.Start(cfg, testPatterns)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(manifestFile))
+	}()
+
+	manifest := start()
+	var paths []string
+	for _, file := range manifest.Files {
+		require.Equal(t, "mock", file.Plugin)
+		require.NotEmpty(t, file.OutputHash)
+		paths = append(paths, file.Path)
+	}
+	require.Equal(t, []string{
+		"one/one-and-a-half/zz_generated.mock.go",
+		"one/zz_generated.mock.go",
+		"two/zz_extra.go",
+		"two/zz_generated.mock.go",
+		"zz_generated.mock.go",
+	}, paths)
+	require.Equal(t, testPath+"/two", manifest.Files[3].Package)
+	require.NotEmpty(t, manifest.Files[3].InputHash)
+
+	extraFile = false
+	manifest = start()
+	require.Len(t, manifest.Files, 4)
+	require.NoFileExists(t, filepath.Join("two", "zz_extra.go"), "files from the previous manifest are cleaned")
+
+	cfg := ggen.Config{ManifestFile: manifestFile}
+	cfg.RegisterPlugin(mock)
+	_, err := ggen.Start(cfg, testPath+"/one")
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join("two", "zz_generated.mock.go"), "files of packages out of the patterns are kept")
+	manifest, err = ggen.ReadManifest(manifestFile)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 4)
+}
+
+func TestStartContext(t *testing.T) {
+	reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var generated []string
+	mock.generate = func(ng ggen.Engine) error {
+		require.Equal(t, ctx, ng.Context())
+		return ng.GenerateEachPackage(func(_ ggen.Engine, pkg *packages.Package, p ggen.Printer) error {
+			generated = append(generated, pkg.PkgPath)
+			mustWrite(p, []byte("var _ = 0\n"))
+			cancel()
+			return nil
+		})
+	}
+	cfg := ggen.Config{}
+	cfg.RegisterPlugin(mock)
+	_, err := ggen.StartContext(ctx, cfg, testPatterns)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Len(t, generated, 1, "stop after the first package")
+
+	output, err := exec.Command("sh", "-c", `find . | grep zz | sort`).
+		CombinedOutput()
+	require.NoError(t, err)
+	require.Empty(t, string(output), "nothing is written")
+}
+
 func mustWrite(w io.Writer, p []byte) {
 	if _, err := w.Write(p); err != nil {
 		panic(err)
@@ -0,0 +1,23 @@
+package two
+
+// +item:func
+func F() {}
+
+type T struct {
+	// +item:field
+	Field int
+}
+
+// +item:method
+func (T) M() {}
+
+type I interface {
+	// +item:interface-method
+	Do()
+}
+
+// +item:const
+const C = 1
+
+// +item:var
+var a, b int